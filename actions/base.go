@@ -2,20 +2,24 @@
 package actions
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"strings"
 
 	"github.com/mitchellh/mapstructure"
 	"github.com/koding/multiconfig"
+
+	"github.com/CheerChen/esalert/redact"
+	"github.com/CheerChen/esalert/tenant"
 )
 
 // Actioner describes an action type. There all multiple action types, but they
 // all simply attempt to perform one action and that's it
 type Actioner interface {
-	// Do takes in the alert context, and possibly returnes an error if the
+	// Do takes in the run context, and possibly returnes an error if the
 	// action failed
-	Do() error
+	Do(ctx context.Context) error
 }
 
 // Action is a wrapper around an Actioner which contains some type information
@@ -57,6 +61,12 @@ func ToActioner(in interface{}) (Action, error) {
 
 type ServerConf struct {
 	Action ActionConf
+	Tenant map[string]TenantConf
+}
+
+// TenantConf holds the channel settings of a single tenant, see [Tenant.<name>.Action]
+type TenantConf struct {
+	Action ActionConf
 }
 
 type ActionConf struct {
@@ -71,4 +81,33 @@ var conf *ServerConf
 func Load(loader *multiconfig.DefaultLoader) {
 	conf = new(ServerConf)
 	loader.MustLoad(conf)
+
+	redact.Secret(conf.Action.MailPwd)
+	for _, t := range conf.Tenant {
+		redact.Secret(t.Action.MailPwd)
+	}
+}
+
+// confFor returns the channel settings of the tenant running ctx. Settings a
+// tenant leaves empty are taken from the global [Action] section, never from
+// another tenant's
+func confFor(ctx context.Context) ActionConf {
+	ac := conf.Action
+	t, ok := conf.Tenant[tenant.FromContext(ctx)]
+	if !ok {
+		return ac
+	}
+	if t.Action.MailHost != "" {
+		ac.MailHost = t.Action.MailHost
+	}
+	if t.Action.MailUsername != "" {
+		ac.MailUsername = t.Action.MailUsername
+	}
+	if t.Action.MailPwd != "" {
+		ac.MailPwd = t.Action.MailPwd
+	}
+	if t.Action.WechatHost != "" {
+		ac.WechatHost = t.Action.WechatHost
+	}
+	return ac
 }
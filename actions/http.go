@@ -1,9 +1,12 @@
 package actions
 
 import (
+	"context"
 	"net/http"
 	"bytes"
 	"fmt"
+
+	"github.com/CheerChen/esalert/tracing"
 )
 
 // HTTP请求动作
@@ -15,11 +18,13 @@ type HTTP struct {
 }
 
 // 执行HTTP请求
-func (h *HTTP) Do() error {
+func (h *HTTP) Do(ctx context.Context) error {
 	r, err := http.NewRequest(h.Method, h.URL, bytes.NewBufferString(h.Body))
 	if err != nil {
 		return err
 	}
+	r = r.WithContext(ctx)
+	tracing.Inject(ctx, r.Header)
 
 	if h.Headers != nil {
 		for k, v := range h.Headers {
@@ -1,6 +1,10 @@
 package actions
 
-import "github.com/CheerChen/esalert/logger"
+import (
+	"context"
+
+	"github.com/CheerChen/esalert/logger"
+)
 
 // 日志动作
 type Log struct {
@@ -8,7 +12,7 @@ type Log struct {
 }
 
 // 只记录日志
-func (l *Log) Do() error {
+func (l *Log) Do(ctx context.Context) error {
 	logger.Info(l.Message)
 	return nil
 }
@@ -1,6 +1,7 @@
 package actions
 
 import (
+	"context"
 	"net/smtp"
 
 	"github.com/domodwyer/mailyak"
@@ -17,20 +18,28 @@ type Mail struct {
 }
 
 // 发送邮件
-func (w *Mail) Do() error {
+func (w *Mail) Do(ctx context.Context) error {
+	ac := confFor(ctx)
 	auth := smtp.PlainAuth(
 		"",
-		conf.Action.MailUsername,
-		conf.Action.MailPwd,
-		conf.Action.MailHost,
+		ac.MailUsername,
+		ac.MailPwd,
+		ac.MailHost,
 	)
-	mail := mailyak.New(conf.Action.MailHost+":25", auth)
+	mail := mailyak.New(ac.MailHost+":25", auth)
 	mail.To(w.To...)
-	mail.From(conf.Action.MailUsername)
+	mail.From(ac.MailUsername)
 	mail.Subject(w.Subject)
 	mail.HTML().Set(w.Content)
 
-	logger.Info("mail sending request", zap.String("content", w.Content))
+	fields := []zap.Field{
+		zap.Int("to", len(w.To)),
+		zap.String("subject", w.Subject),
+	}
+	if logger.Verbose() {
+		fields = append(fields, zap.String("content", w.Content))
+	}
+	logger.Info("mail sending request", fields...)
 
 	if err := mail.Send(); err != nil {
 		return err
@@ -1,6 +1,7 @@
 package actions
 
 import (
+	"context"
 	"net/http"
 	"fmt"
 	"strings"
@@ -9,6 +10,7 @@ import (
 	"go.uber.org/zap"
 
 	"github.com/CheerChen/esalert/logger"
+	"github.com/CheerChen/esalert/tracing"
 )
 
 // 企业微信动作
@@ -19,16 +21,25 @@ type Wechat struct {
 }
 
 // 群发
-func (w *Wechat) Do() error {
+func (w *Wechat) Do(ctx context.Context) error {
 	body := "receiver=" + strings.Join(w.Users, ",") + "&subject=" + w.Subject + "&content=" + w.Content
 
-	logger.Info("wechat sending request", zap.String("body", body))
+	fields := []zap.Field{
+		zap.Int("users", len(w.Users)),
+		zap.String("subject", w.Subject),
+	}
+	if logger.Verbose() {
+		fields = append(fields, zap.String("body", body))
+	}
+	logger.Info("wechat sending request", fields...)
 
-	r, err := http.NewRequest("POST", conf.Action.WechatHost, bytes.NewBufferString(body))
+	r, err := http.NewRequest("POST", confFor(ctx).WechatHost, bytes.NewBufferString(body))
 	if err != nil {
 		return err
 	}
+	r = r.WithContext(ctx)
 	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	tracing.Inject(ctx, r.Header)
 	resp, err := http.DefaultClient.Do(r)
 	if err != nil {
 		return err
@@ -1,114 +1,255 @@
 package alert
 
 import (
-	"bytes"
+	"context"
+	"errors"
 	"fmt"
-	"html/template"
+	"sync"
+	"sync/atomic"
 	"time"
 
-	"gopkg.in/yaml.v2"
+	"go.opentelemetry.io/otel/attribute"
 	"go.uber.org/zap"
 
 	"github.com/CheerChen/esalert/actions"
+	"github.com/CheerChen/esalert/events"
 	"github.com/CheerChen/esalert/logger"
+	"github.com/CheerChen/esalert/metrics"
+	"github.com/CheerChen/esalert/tenant"
+	"github.com/CheerChen/esalert/tracing"
 )
 
 type Alert struct {
 	Name      string
-	Interval  string    `yaml:"interval"`
-	Search    Dict      `yaml:"search"`
-	SearchUrl string    `yaml:"search_url"`
-	Process   LuaRunner `yaml:"process"`
+	Tenant    string      `yaml:"-"`
+	UserId    string      `yaml:"-"`
+	Interval  string      `yaml:"interval"`
+	Input     Dict        `yaml:"input"` // {type: ..., ...}, see ToInputer
+	Search    Dict        `yaml:"search"`
+	SQL       string      `yaml:"sql"` // elasticsearch sql statement, replaces search
+	EQL       interface{} `yaml:"eql"` // eql statement or request body, replaces search
+	SearchUrl string      `yaml:"search_url"`
+	Cluster   string      `yaml:"cluster"` // name of a configured cluster, replaces search_url
+	Index     string      `yaml:"index"`   // index pattern searched on the cluster
+	Process   LuaRunner   `yaml:"process"`
 
-	Timer     *FullTimeSpec
-	SearchTPL *template.Template
-}
+	// Query holds timeframe, filter, group_by and metric, which are compiled
+	// into search
+	Query `yaml:",inline"`
 
-func templateHelper(i interface{}, lastErr error) (*template.Template, error) {
-	if lastErr != nil {
-		return nil, lastErr
-	}
-	var str string
-	if s, ok := i.(string); ok {
-		str = s
-	} else {
-		b, err := yaml.Marshal(i)
-		if err != nil {
-			return nil, err
-		}
-		str = string(b)
-	}
+	// TrackTotalHits is added to the search body as track_total_hits unless
+	// the body sets it. true counts every hit on elasticsearch 7+, a number
+	// counts up to that many
+	TrackTotalHits interface{} `yaml:"track_total_hits"`
+	// PartialResults is "allow" (the default) to process searches where some
+	// shards failed, or "fail" to fail the run instead
+	PartialResults string `yaml:"partial_results"`
+	// Paginate collects every hit instead of the first page only
+	Paginate *Paginate `yaml:"paginate"`
+	// Searches are named inputs fetched concurrently with the main one, the
+	// result of each is ctx.Results.<name>. Their type defaults to search
+	Searches map[string]Dict `yaml:"searches"`
 
-	return template.New("").Parse(str)
+	Timer  *FullTimeSpec
+	Source Input            // built from Input, or from the search fields without one
+	Named  map[string]Input // built from Searches
 }
 
 func (a *Alert) Init() error {
-	var err error
-	a.SearchTPL, err = templateHelper(&a.Search, err)
-	if err != nil {
-		return err
-	}
-
 	timer, err := ParseFullTimeSpec(a.Interval)
 	if err != nil {
 		return fmt.Errorf("parsing interval: %s", err)
 	}
 	a.Timer = timer
 
+	if a.Input != nil {
+		if a.Source, err = ToInputer(a.Input); err != nil {
+			return err
+		}
+	} else if a.Cluster != "" || a.SearchUrl != "" {
+		if a.Source, err = a.shorthandInput(); err != nil {
+			return err
+		}
+	} else if len(a.Searches) == 0 {
+		return errors.New("either input, searches, cluster or search_url is required")
+	}
+	if a.Source.Inputer != nil {
+		if err := a.Source.Init(a.Tenant); err != nil {
+			return fmt.Errorf("%s input: %s", a.Source.Type, err)
+		}
+	}
+
+	a.Named = make(map[string]Input, len(a.Searches))
+	for name, def := range a.Searches {
+		if _, ok := def["type"]; !ok {
+			def["type"] = "search"
+		}
+		in, err := ToInputer(def)
+		if err != nil {
+			return fmt.Errorf("searches.%s: %s", name, err)
+		}
+		if err := in.Init(a.Tenant); err != nil {
+			return fmt.Errorf("searches.%s: %s input: %s", name, in.Type, err)
+		}
+		a.Named[name] = in
+	}
+
+	switch a.PartialResults {
+	case "", PartialAllow, PartialFail:
+	default:
+		return fmt.Errorf("partial_results must be %q or %q", PartialAllow, PartialFail)
+	}
+
 	return nil
 }
 
-func (a Alert) Run() {
+const (
+	StatusOK       = "ok"        // search and process succeeded, every action was sent
+	StatusNoAction = "no_action" // search and process succeeded, nothing to send
+	StatusFailed   = "failed"    // the run stopped at Record.Step
+)
+
+const (
+	PartialAllow = "allow"
+	PartialFail  = "fail"
+)
+
+// Record describes the outcome of a single Run, the caller keeps it as run
+// history
+type Record struct {
+	StartedAt time.Time
+	Duration  time.Duration
+	Status    string
+	Step      string // query, search, process or action
+	Hits      uint64
+	Actions   int
+	Error     string
+	ErrorType string // type of the elasticsearch error, or "partial_results"
+	Shards    ShardInfo
+	Cache     string // "hit" if every cached search hit, "miss" if one missed
+	Searches  int    // elasticsearch requests sent, every page counted
+	TraceId   string
+}
+
+func (a Alert) Run() (rec Record) {
 	now := time.Now()
+	rec = Record{StartedAt: now, Status: StatusFailed}
+
+	ctx, span := tracing.Start(tenant.NewContext(context.Background(), a.Tenant), "alert.Run",
+		attribute.String("job", a.Name),
+		attribute.String("tenant", a.Tenant),
+	)
+	rec.TraceId = tracing.TraceID(ctx)
+	requests := new(int64)
+	ctx = context.WithValue(ctx, requestsKey{}, requests)
+	defer func() {
+		rec.Duration = time.Since(now)
+		rec.Searches = int(atomic.LoadInt64(requests))
+		a.publish(events.RunFinished, map[string]interface{}{
+			"status":      rec.Status,
+			"step":        rec.Step,
+			"error":       rec.Error,
+			"duration_ms": int64(rec.Duration / time.Millisecond),
+		})
+		span.SetAttributes(
+			attribute.String("status", rec.Status),
+			attribute.String("step", rec.Step),
+		)
+		if rec.Error != "" {
+			tracing.End(span, errors.New(rec.Error))
+		} else {
+			span.End()
+		}
+	}()
+
 	c := Context{
 		Name:      a.Name,
 		StartedTS: uint64(now.Unix()),
 		Time:      now,
 	}
 
-	searchQuery, err := a.CreateSearchQuery(c)
-	if err != nil {
-		logger.Error("failed to create search query",
-			zap.String("err", err.Error()),
-			zap.String("id", a.Name),
-		)
-		return
-	}
-
-	logger.Info("running search step")
+	logger.Debug("running search step",
+		zap.String("id", a.Name),
+		zap.String("input", a.Source.Type),
+	)
 
-	res, err := Search(a.SearchUrl, searchQuery)
+	rec.Step = "search"
+	res, results, err := a.fetch(ctx, c)
+	rec.Shards = res.Shards
+	rec.Cache = cacheStatus(res, results)
 	if err != nil {
+		cause := err
+		if ne, ok := err.(*namedError); ok {
+			cause = ne.err
+		}
+		switch e := cause.(type) {
+		case *ElasticError:
+			rec.ErrorType = e.Type
+			rec.Shards.Failures = e.FailedShards
+		case *PartialError:
+			rec.ErrorType = "partial_results"
+		case renderError:
+			rec.Step = "query"
+		}
+		a.publish(events.SearchDone, map[string]interface{}{
+			"error":      err.Error(),
+			"error_type": rec.ErrorType,
+		})
 		logger.Error("failed at search step",
 			zap.String("err", err.Error()),
 			zap.String("id", a.Name),
 		)
-		return
+		rec.Error = err.Error()
+		return rec
 	}
 	c.Result = res
+	c.Results = results
+	rec.Hits = res.HitInfo.HitCount
+	if a.Source.Inputer == nil {
+		for _, r := range results {
+			rec.Hits += r.HitCount
+		}
+	}
+	a.publish(events.SearchDone, map[string]interface{}{
+		"hits":          res.HitInfo.HitCount,
+		"hits_relation": res.HitInfo.HitCountRelation,
+		"took_ms":       res.TookMS,
+		"shards_failed": res.Shards.Failed,
+		"collected":     len(res.Hits),
+		"searches":      len(results),
+	})
 
 	logger.Info("running process step",
 		zap.Uint64("hits", res.HitInfo.HitCount),
+		zap.String("relation", res.HitInfo.HitCountRelation),
 		zap.String("id", a.Name),
 	)
 
+	rec.Step = "process"
+	_, pspan := tracing.Start(ctx, "lua")
 	processRes, ok := a.Process.Do(c)
+	pspan.End()
 	if !ok {
 		logger.Error("failed at process step",
-			zap.String("err", err.Error()),
 			zap.String("id", a.Name),
 		)
-		return
+		rec.Error = "lua process failed"
+		return rec
 	}
 
 	actionsRaw, _ := processRes.([]interface{})
+	a.publish(events.LuaResult, map[string]interface{}{
+		"actions": len(actionsRaw),
+	})
 	if len(actionsRaw) == 0 {
 		logger.Info("no actions returned",
 			zap.String("id", a.Name),
 		)
-		return
+		rec.Status = StatusNoAction
+		return rec
 	}
 
+	rec.Step = "action"
 	acts := make([]actions.Action, len(actionsRaw))
 	for i := range actionsRaw {
 		act, err := actions.ToActioner(actionsRaw[i])
@@ -116,39 +257,242 @@ func (a Alert) Run() {
 			logger.Error("error unpacking action",
 				zap.String("id", a.Name),
 			)
-			return
+			rec.Error = err.Error()
+			return rec
 		}
 		acts[i] = act
 	}
 
 	for i := range acts {
-		logger.Info("running action step")
-		if err := acts[i].Do(); err != nil {
+		logger.Debug("running action step",
+			zap.String("id", a.Name),
+			zap.String("type", acts[i].Type),
+		)
+		actx, aspan := tracing.Start(ctx, "action."+acts[i].Type)
+		err := acts[i].Do(actx)
+		tracing.End(aspan, err)
+		if err != nil {
+			metrics.Actions.WithLabelValues(acts[i].Type, "failed").Inc()
+			a.publish(events.ActionFailed, map[string]interface{}{
+				"type":  acts[i].Type,
+				"error": err.Error(),
+			})
 			logger.Error("failed to complete action",
 				zap.String("err", err.Error()),
 				zap.String("id", a.Name),
 			)
-			return
+			rec.Error = err.Error()
+			return rec
 		}
+		metrics.Actions.WithLabelValues(acts[i].Type, "ok").Inc()
+		a.publish(events.ActionSent, map[string]interface{}{
+			"type": acts[i].Type,
+		})
+		rec.Actions++
 	}
+
+	rec.Status = StatusOK
+	return rec
 }
 
-func (a Alert) CreateSearchQuery(c Context) (interface{}, error) {
-	buf := bytes.NewBuffer(make([]byte, 0, 1024))
+// cacheStatus sums up the cache status of the results of a run, empty when
+// no search went through a cache
+func cacheStatus(res Result, results map[string]Result) string {
+	status := res.Cache
+	for _, r := range results {
+		if r.Cache == "miss" || status == "" {
+			status = r.Cache
+		}
+	}
+	return status
+}
+
+// namedError is the failure of one of the named searches
+type namedError struct {
+	name string
+	err  error
+}
+
+func (e *namedError) Error() string {
+	return "searches." + e.name + ": " + e.err.Error()
+}
+
+// fetch runs the main input and every named search concurrently. The first
+// error is returned, results with failed shards are errors under the
+// "fail" PartialResults policy
+func (a Alert) fetch(ctx context.Context, c Context) (Result, map[string]Result, error) {
+	var main Result
+	results := make(map[string]Result, len(a.Named))
+	var firstErr error
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+
+	run := func(name string, in Input) {
+		defer wg.Done()
+		sctx, span := tracing.Start(ctx, "input."+in.Type, attribute.String("name", name))
+		res, err := in.Fetch(sctx, c)
+		if err == nil {
+			err = a.checkShards(name, res)
+		}
+		tracing.End(span, err)
+
+		mu.Lock()
+		defer mu.Unlock()
+		if name == "" {
+			main = res
+		} else {
+			results[name] = res
+			if err != nil {
+				err = &namedError{name: name, err: err}
+			}
+		}
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
 
-	if err := a.SearchTPL.Execute(buf, &c); err != nil {
-		return nil, err
+	if a.Source.Inputer != nil {
+		wg.Add(1)
+		go run("", a.Source)
 	}
-	searchRaw := buf.Bytes()
-	logger.Info("create search query",
-		zap.ByteString("searchRaw", searchRaw),
+	for name, in := range a.Named {
+		wg.Add(1)
+		go run(name, in)
+	}
+	wg.Wait()
+	return main, results, firstErr
+}
+
+// checkShards logs results with failed shards, which fail the run under the
+// "fail" PartialResults policy
+func (a Alert) checkShards(name string, res Result) error {
+	if !res.Shards.Partial() {
+		return nil
+	}
+	logger.Warn("partial search results",
 		zap.String("id", a.Name),
+		zap.String("search", name),
+		zap.Int("failed", res.Shards.Failed),
+		zap.Int("total", res.Shards.Total),
+		zap.Strings("reasons", res.Shards.Reasons()),
 	)
+	if a.PartialResults == PartialFail {
+		return &PartialError{Shards: res.Shards}
+	}
+	return nil
+}
+
+func (a Alert) publish(typ string, data map[string]interface{}) {
+	events.Publish(events.Event{
+		Type:   typ,
+		JobId:  a.Name,
+		Tenant: a.Tenant,
+		UserId: a.UserId,
+		Data:   data,
+	})
+}
+
+// shorthandInput builds the input of an alert with top level search, sql or
+// eql fields
+func (a Alert) shorthandInput() (Input, error) {
+	set := 0
+	for _, ok := range []bool{a.Search != nil || !a.Query.Empty(), a.SQL != "", a.EQL != nil} {
+		if ok {
+			set++
+		}
+	}
+	if set > 1 {
+		return Input{}, errors.New("only one of search, sql and eql can be set")
+	}
 
-	var search Dict
-	if err := yaml.Unmarshal(searchRaw, &search); err != nil {
-		return nil, err
+	target := esTarget{Cluster: a.Cluster}
+	index := a.Index
+	if a.Cluster == "" {
+		target.URL = nodeURL(a.SearchUrl)
+		index = indexOf(adhoc, a.SearchUrl)
 	}
+	switch {
+	case a.SQL != "":
+		return Input{Type: "es_sql", Inputer: &SQLQueryInput{esTarget: target, Query: a.SQL}}, nil
+	case a.EQL != nil:
+		return Input{Type: "eql", Inputer: &EQLInput{esTarget: target, Index: index, Query: a.EQL}}, nil
+	}
+
+	s := &SearchInput{
+		esTarget:       target,
+		Index:          a.Index,
+		Body:           a.Search,
+		TrackTotalHits: a.TrackTotalHits,
+		Paginate:       a.Paginate,
+		Query:          a.Query,
+	}
+	if a.Cluster == "" {
+		s.searchURL = a.SearchUrl
+	}
+	return Input{Type: "search", Inputer: s}, nil
+}
+
+// Queries renders the request bodies of the main input and of the named
+// searches as a run at now would send them. Inputs without a query are left
+// out
+func (a Alert) Queries(now time.Time) (interface{}, map[string]interface{}, error) {
+	c := queryContext(a.Name, now)
+	var main interface{}
+	if r, ok := a.Source.Inputer.(Renderer); ok {
+		var err error
+		if main, err = r.Render(c); err != nil {
+			return nil, nil, err
+		}
+	}
+	named := make(map[string]interface{}, len(a.Named))
+	for name, in := range a.Named {
+		if r, ok := in.Inputer.(Renderer); ok {
+			q, err := r.Render(c)
+			if err != nil {
+				return nil, nil, fmt.Errorf("searches.%s: %s", name, err)
+			}
+			named[name] = q
+		}
+	}
+	return main, named, nil
+}
+
+type requestsKey struct{}
+
+// countRequest adds an elasticsearch request to the Searches of the run
+// ctx belongs to
+func countRequest(ctx context.Context) {
+	if n, ok := ctx.Value(requestsKey{}).(*int64); ok {
+		atomic.AddInt64(n, 1)
+	}
+}
 
-	return search, nil
+// InputCount returns how many inputs a run of the alert fetches, the least
+// number of searches it sends
+func (a Alert) InputCount() int {
+	n := len(a.Named)
+	if a.Source.Inputer != nil {
+		n++
+	}
+	return n
+}
+
+// queryContext is the context of a run of the alert name starting at now,
+// before anything was searched
+func queryContext(name string, now time.Time) Context {
+	return Context{
+		Name:      name,
+		StartedTS: uint64(now.Unix()),
+		Time:      now,
+	}
+}
+
+// CreateSearchQuery renders the request body the alert sends to
+// elasticsearch for c
+func (a Alert) CreateSearchQuery(c Context) (interface{}, error) {
+	r, ok := a.Source.Inputer.(Renderer)
+	if !ok {
+		return nil, fmt.Errorf("%s input has no search query", a.Source.Type)
+	}
+	return r.Render(c)
 }
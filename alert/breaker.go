@@ -0,0 +1,86 @@
+package alert
+
+import (
+	"sync"
+	"time"
+)
+
+// breaker stops requests to a cluster after max consecutive failures, so a
+// flapping cluster fails fast instead of tying up every run until its
+// timeout. Once cooldown has passed a single trial request is let through,
+// its outcome closes the breaker or opens it again
+type breaker struct {
+	max      int
+	cooldown time.Duration
+
+	mu       sync.Mutex
+	failures int
+	openedAt time.Time
+	trial    bool // a trial request is in flight
+}
+
+// allow tells whether a request may be sent, and whether it is the trial
+// request of an open breaker. The trial is passed back to record or cancel
+func (b *breaker) allow() (ok, trial bool) {
+	if b == nil || b.max <= 0 {
+		return true, false
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.failures < b.max {
+		return true, false
+	}
+	if b.trial || time.Since(b.openedAt) < b.cooldown {
+		return false, false
+	}
+	b.trial = true
+	return true, true
+}
+
+// record counts the outcome of an allowed request, and returns whether it
+// opened the breaker. While the breaker is open only the trial counts, the
+// requests sent before it opened can't close or reopen it
+func (b *breaker) record(trial, ok bool) bool {
+	if b == nil || b.max <= 0 {
+		return false
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.failures >= b.max && !trial {
+		return false
+	}
+	if trial {
+		b.trial = false
+	}
+	if ok {
+		b.failures = 0
+		return false
+	}
+	b.failures++
+	if b.failures >= b.max {
+		b.openedAt = time.Now()
+		return true
+	}
+	return false
+}
+
+// cancel ends an allowed request which has no outcome, e.g. when its caller
+// gave up, a trial is then let through again
+func (b *breaker) cancel(trial bool) {
+	if b == nil || !trial {
+		return
+	}
+	b.mu.Lock()
+	b.trial = false
+	b.mu.Unlock()
+}
+
+// open tells whether requests are rejected, but for a trial
+func (b *breaker) open() bool {
+	if b == nil || b.max <= 0 {
+		return false
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.failures >= b.max
+}
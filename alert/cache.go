@@ -0,0 +1,113 @@
+package alert
+
+import (
+	"context"
+	"encoding/json"
+	"sync"
+	"time"
+
+	"github.com/CheerChen/esalert/metrics"
+)
+
+// queryCache keeps the responses of a cluster for a short while, so alerts
+// rendering byte-identical searches on the same tick query elasticsearch
+// once. Concurrent identical searches wait for the one in flight
+type queryCache struct {
+	ttl time.Duration
+
+	mu      sync.Mutex
+	entries map[string]*cacheEntry
+}
+
+type cacheEntry struct {
+	ready   chan struct{} // closed once raw and err are set
+	raw     []byte
+	err     error
+	expires time.Time // zero while in flight
+}
+
+func newQueryCache(ttl time.Duration) *queryCache {
+	return &queryCache{ttl: ttl, entries: map[string]*cacheEntry{}}
+}
+
+// get returns the cached response of key, or calls fetch to get it. hit is
+// false for the caller which ran fetch, and for the callers waiting on a
+// fetch which failed. Errors are shared with those callers but never cached
+func (c *queryCache) get(key string, fetch func() ([]byte, error)) (raw []byte, hit bool, err error) {
+	c.mu.Lock()
+	if e, ok := c.entries[key]; ok && (e.expires.IsZero() || time.Now().Before(e.expires)) {
+		c.mu.Unlock()
+		<-e.ready
+		return e.raw, e.err == nil, e.err
+	}
+	e := &cacheEntry{ready: make(chan struct{})}
+	c.entries[key] = e
+	c.mu.Unlock()
+
+	e.raw, e.err = fetch()
+
+	c.mu.Lock()
+	if e.err != nil {
+		delete(c.entries, key)
+	} else {
+		e.expires = time.Now().Add(c.ttl)
+		time.AfterFunc(c.ttl, func() {
+			c.mu.Lock()
+			if c.entries[key] == e {
+				delete(c.entries, key)
+			}
+			c.mu.Unlock()
+		})
+	}
+	c.mu.Unlock()
+	close(e.ready)
+	return e.raw, false, e.err
+}
+
+// search runs a search of index on the cluster through its cache and
+// batcher when they are configured
+func (cl *cluster) search(ctx context.Context, index string, query interface{}) (Result, error) {
+	body, err := json.Marshal(query)
+	if err != nil {
+		return Result{}, err
+	}
+	fetch := func() ([]byte, error) {
+		if cl.batcher != nil {
+			return cl.batcher.search(ctx, index, body)
+		}
+		return cl.searchRaw(ctx, index+"/_search", body)
+	}
+	if cl.cache == nil {
+		raw, err := fetch()
+		if err != nil {
+			return Result{}, err
+		}
+		return decodeResult(raw)
+	}
+
+	raw, hit, err := cl.cache.get(index+"\n"+string(body), func() ([]byte, error) {
+		raw, err := fetch()
+		if err != nil {
+			return nil, err
+		}
+		// a search which timed out is incomplete, don't keep it
+		var head struct {
+			TimedOut bool `json:"timed_out"`
+		}
+		if json.Unmarshal(raw, &head); head.TimedOut {
+			return nil, errTimedOut
+		}
+		return raw, nil
+	})
+	cache := "miss"
+	if hit {
+		cache = "hit"
+	}
+	metrics.SearchCache.WithLabelValues(cl.label(), cache).Inc()
+	if err != nil {
+		return Result{Cache: cache}, err
+	}
+	res, err := decodeResult(raw)
+	res.Cache = cache
+	return res, err
+}
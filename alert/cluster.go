@@ -0,0 +1,511 @@
+package alert
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/CheerChen/esalert/logger"
+	"github.com/CheerChen/esalert/metrics"
+	"github.com/CheerChen/esalert/redact"
+	"github.com/CheerChen/esalert/tenant"
+	"github.com/CheerChen/esalert/tracing"
+)
+
+// ClusterConf describes a named elasticsearch cluster, see [Cluster.<name>].
+// Alerts refer to it with "cluster: <name>" instead of a full search_url
+type ClusterConf struct {
+	URLs   []string // base urls of the nodes, e.g. "https://es1:9200"
+	User   string   // basic auth
+	Pass   string
+	APIKey string // sent as "Authorization: ApiKey <APIKey>"
+	Bearer string // sent as "Authorization: Bearer <Bearer>"
+
+	CAFile             string // pem bundle used to verify the nodes
+	CertFile           string // client certificate
+	KeyFile            string
+	InsecureSkipVerify bool
+	Proxy              string // e.g. "http://proxy:3128", empty uses the environment
+
+	Timeout      string // of a single attempt, default "5s"
+	DialTimeout  string // default "2s"
+	MaxIdleConns int    // idle connections kept per node, default 10
+
+	// Retries on connection errors, 429 and 5xx, each on the next node in
+	// URLs. Default 2, -1 disables retries
+	Retries      int
+	RetryBackoff string // before the first retry, doubled on every retry, default "100ms"
+
+	// BreakerFailures consecutive failed requests open the circuit breaker,
+	// which rejects requests until BreakerCooldown has passed. Default 5, -1
+	// disables the breaker
+	BreakerFailures int
+	BreakerCooldown string // default "30s"
+
+	// BatchWindow groups the searches sent within it into one _msearch
+	// request, e.g. "20ms". Empty sends every search on its own
+	BatchWindow string
+	BatchSize   int // searches per _msearch at most, default 50
+
+	// RateLimit, RateBurst, MaxConcurrent and QueueTimeout limit the requests
+	// sent to the cluster, see ClusterLimits. They can be changed at runtime
+	// with PUT /cluster/limits/:name
+	RateLimit     float64
+	RateBurst     int
+	MaxConcurrent int
+	QueueTimeout  string
+
+	// CacheTTL keeps search responses for that long, identical searches
+	// within it are answered from the cache. Empty disables the cache
+	CacheTTL string
+}
+
+// ErrCircuitOpen is returned without contacting a cluster whose circuit
+// breaker is open
+var ErrCircuitOpen = errors.New("circuit breaker open")
+
+type cluster struct {
+	name    string
+	conf    ClusterConf
+	client  *http.Client
+	backoff time.Duration
+	breaker *breaker
+	batcher *batcher    // nil without BatchWindow
+	cache   *queryCache // nil without CacheTTL
+	limiter *limiter    // nil for search_url alerts
+
+	node int32 // index into URLs of the node tried first, read atomically
+}
+
+// withDefaults fills in the zero values of the client settings
+func (cc ClusterConf) withDefaults() ClusterConf {
+	if cc.Timeout == "" {
+		cc.Timeout = "5s"
+	}
+	if cc.DialTimeout == "" {
+		cc.DialTimeout = "2s"
+	}
+	if cc.MaxIdleConns == 0 {
+		cc.MaxIdleConns = 10
+	}
+	if cc.Retries == 0 {
+		cc.Retries = 2
+	}
+	if cc.RetryBackoff == "" {
+		cc.RetryBackoff = "100ms"
+	}
+	if cc.BreakerFailures == 0 {
+		cc.BreakerFailures = 5
+	}
+	if cc.BreakerCooldown == "" {
+		cc.BreakerCooldown = "30s"
+	}
+	if cc.BatchSize == 0 {
+		cc.BatchSize = 50
+	}
+	return cc
+}
+
+func newCluster(name string, cc ClusterConf) (*cluster, error) {
+	cc = cc.withDefaults()
+	backoff, err := time.ParseDuration(cc.RetryBackoff)
+	if err != nil {
+		return nil, fmt.Errorf("RetryBackoff: %s", err)
+	}
+	cooldown, err := time.ParseDuration(cc.BreakerCooldown)
+	if err != nil {
+		return nil, fmt.Errorf("BreakerCooldown: %s", err)
+	}
+	client, err := newClusterClient(cc)
+	if err != nil {
+		return nil, err
+	}
+	cl := &cluster{
+		name:    name,
+		conf:    cc,
+		client:  client,
+		backoff: backoff,
+		breaker: &breaker{max: cc.BreakerFailures, cooldown: cooldown},
+	}
+	if cc.BatchWindow != "" {
+		window, err := time.ParseDuration(cc.BatchWindow)
+		if err != nil {
+			return nil, fmt.Errorf("BatchWindow: %s", err)
+		}
+		cl.batcher = &batcher{cl: cl, window: window, max: cc.BatchSize}
+	}
+	limits := ClusterLimits{
+		RateLimit:     cc.RateLimit,
+		RateBurst:     cc.RateBurst,
+		MaxConcurrent: cc.MaxConcurrent,
+		QueueTimeout:  cc.QueueTimeout,
+	}
+	if cl.limiter, err = newLimiter(name, limits); err != nil {
+		return nil, err
+	}
+	if cc.CacheTTL != "" {
+		ttl, err := time.ParseDuration(cc.CacheTTL)
+		if err != nil {
+			return nil, fmt.Errorf("CacheTTL: %s", err)
+		}
+		cl.cache = newQueryCache(ttl)
+	}
+	return cl, nil
+}
+
+var (
+	clustersMu sync.RWMutex
+	// keyed by name for global clusters and by "<tenant>/<name>" for tenant ones
+	clusters = make(map[string]*cluster)
+)
+
+func loadClusters(sc *ServerConf) error {
+	m := make(map[string]*cluster)
+	add := func(key, name string, cc ClusterConf) error {
+		if len(cc.URLs) == 0 {
+			return fmt.Errorf("cluster %s: no URLs", key)
+		}
+		cl, err := newCluster(name, cc)
+		if err != nil {
+			return fmt.Errorf("cluster %s: %s", key, err)
+		}
+		redact.Secret(cc.Pass, cc.APIKey, cc.Bearer)
+		m[key] = cl
+		return nil
+	}
+	for name, cc := range sc.Cluster {
+		if err := add(name, name, cc); err != nil {
+			return err
+		}
+	}
+	for t, tc := range sc.Tenant {
+		for name, cc := range tc.Cluster {
+			if err := add(t+"/"+name, name, cc); err != nil {
+				return err
+			}
+		}
+	}
+
+	clustersMu.Lock()
+	clusters = m
+	clustersMu.Unlock()
+	return nil
+}
+
+func newClusterClient(cc ClusterConf) (*http.Client, error) {
+	timeout, err := time.ParseDuration(cc.Timeout)
+	if err != nil {
+		return nil, fmt.Errorf("Timeout: %s", err)
+	}
+	dialTimeout, err := time.ParseDuration(cc.DialTimeout)
+	if err != nil {
+		return nil, fmt.Errorf("DialTimeout: %s", err)
+	}
+
+	tlsConf := &tls.Config{InsecureSkipVerify: cc.InsecureSkipVerify}
+	if cc.CAFile != "" {
+		pem, err := ioutil.ReadFile(cc.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, errors.New("no certificate found in CAFile")
+		}
+		tlsConf.RootCAs = pool
+	}
+	if cc.CertFile != "" || cc.KeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(cc.CertFile, cc.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConf.Certificates = []tls.Certificate{cert}
+	}
+
+	proxy := http.ProxyFromEnvironment
+	if cc.Proxy != "" {
+		u, err := url.Parse(cc.Proxy)
+		if err != nil {
+			return nil, err
+		}
+		proxy = http.ProxyURL(u)
+	}
+
+	return &http.Client{
+		Timeout: timeout,
+		Transport: &http.Transport{
+			Proxy: proxy,
+			DialContext: (&net.Dialer{
+				Timeout:   dialTimeout,
+				KeepAlive: 30 * time.Second,
+			}).DialContext,
+			TLSClientConfig:     tlsConf,
+			TLSHandshakeTimeout: dialTimeout,
+			MaxIdleConns:        cc.MaxIdleConns * len(cc.URLs),
+			MaxIdleConnsPerHost: cc.MaxIdleConns,
+			IdleConnTimeout:     90 * time.Second,
+		},
+	}, nil
+}
+
+// adhoc is shared by every search_url alert, so they reuse connections too
+var adhoc *cluster
+
+func init() {
+	var err error
+	adhoc, err = newCluster("", ClusterConf{BreakerFailures: -1})
+	if err != nil {
+		panic(err)
+	}
+}
+
+// lookupCluster finds a cluster by name, clusters of the tenant take
+// precedence over global ones. Other tenants' clusters are never returned
+func lookupCluster(tenantName, name string) (*cluster, error) {
+	if tenantName == "" {
+		tenantName = tenant.Default
+	}
+	clustersMu.RLock()
+	defer clustersMu.RUnlock()
+	if cl, ok := clusters[tenantName+"/"+name]; ok {
+		return cl, nil
+	}
+	if cl, ok := clusters[name]; ok {
+		return cl, nil
+	}
+	return nil, fmt.Errorf("unknown cluster: %q", name)
+}
+
+// adhocCluster is used by search_url alerts, which carry the full url
+// themselves and are authenticated with the [Elastic] credentials of the
+// tenant running ctx
+func adhocCluster(ctx context.Context) *cluster {
+	ec := elasticConfFor(ctx)
+	cc := adhoc.conf
+	cc.User, cc.Pass = ec.User, ec.Pass
+	return &cluster{
+		conf:    cc,
+		client:  adhoc.client,
+		backoff: adhoc.backoff,
+	}
+}
+
+// PingClusters checks every registered cluster answers, keyed like the
+// registry
+func PingClusters(ctx context.Context) map[string]error {
+	clustersMu.RLock()
+	m := make(map[string]*cluster, len(clusters))
+	for k, cl := range clusters {
+		m[k] = cl
+	}
+	clustersMu.RUnlock()
+
+	res := make(map[string]error, len(m))
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for k, cl := range m {
+		wg.Add(1)
+		go func(k string, cl *cluster) {
+			defer wg.Done()
+			err := cl.ping(ctx, "/")
+			mu.Lock()
+			res[k] = err
+			mu.Unlock()
+		}(k, cl)
+	}
+	wg.Wait()
+	return res
+}
+
+// url resolves path against the base url of node n, ad hoc clusters take
+// path as a full url
+func (cl *cluster) url(n int, path string) string {
+	if len(cl.conf.URLs) == 0 {
+		return path
+	}
+	base := cl.conf.URLs[n%len(cl.conf.URLs)]
+	return strings.TrimRight(base, "/") + "/" + strings.TrimLeft(path, "/")
+}
+
+func (cl *cluster) authorize(req *http.Request) {
+	switch {
+	case cl.conf.APIKey != "":
+		req.Header.Set("Authorization", "ApiKey "+cl.conf.APIKey)
+	case cl.conf.Bearer != "":
+		req.Header.Set("Authorization", "Bearer "+cl.conf.Bearer)
+	case cl.conf.User != "":
+		req.SetBasicAuth(cl.conf.User, cl.conf.Pass)
+	}
+}
+
+func (cl *cluster) label() string {
+	if cl.name == "" {
+		return "search_url"
+	}
+	return cl.name
+}
+
+// retryable tells whether a response status is worth another attempt
+func retryable(status int) bool {
+	return status == http.StatusTooManyRequests || status >= 500
+}
+
+// request sends a json body to path on the cluster and returns the status
+// code and body of the response. Connection errors, 429 and 5xx are retried
+// with exponential backoff on the next node, until Retries or the deadline
+// of ctx run out
+func (cl *cluster) request(ctx context.Context, method, path string, body []byte) (int, []byte, error) {
+	// wait for the limits first, a trial let through by a half-open breaker
+	// must be sent
+	release, err := cl.limiter.acquire(ctx)
+	if err != nil {
+		return 0, nil, fmt.Errorf("cluster %s: %s", cl.name, err)
+	}
+	defer release()
+	allowed, trial := cl.breaker.allow()
+	if !allowed {
+		return 0, nil, fmt.Errorf("cluster %s: %s", cl.name, ErrCircuitOpen)
+	}
+	countRequest(ctx)
+
+	node := int(atomic.LoadInt32(&cl.node))
+	backoff := cl.backoff
+	var status int
+	var respBody []byte
+	for attempt := 0; ; attempt++ {
+		status, respBody, err = cl.send(ctx, method, cl.url(node, path), body)
+		if err == nil && !retryable(status) {
+			break
+		}
+		if attempt >= cl.conf.Retries || ctx.Err() != nil {
+			break
+		}
+
+		fields := []zap.Field{
+			zap.String("cluster", cl.label()),
+			zap.Int("attempt", attempt+1),
+			zap.Int("status", status),
+			zap.Duration("backoff", backoff),
+		}
+		if err != nil {
+			fields = append(fields, zap.String("err", err.Error()))
+		}
+		logger.Warn("retrying search request", fields...)
+		metrics.SearchRetries.WithLabelValues(cl.label()).Inc()
+
+		select {
+		case <-time.After(backoff + time.Duration(rand.Int63n(int64(backoff/2)+1))):
+		case <-ctx.Done():
+		}
+		if ctx.Err() != nil {
+			err = ctx.Err()
+			break
+		}
+		backoff *= 2
+		if len(cl.conf.URLs) > 1 {
+			node = (node + 1) % len(cl.conf.URLs)
+		}
+	}
+
+	if err != nil && ctx.Err() != nil {
+		// the caller gave up or ran out of time, which tells nothing about
+		// the cluster
+		cl.breaker.cancel(trial)
+		return status, respBody, err
+	}
+	ok := err == nil && !retryable(status)
+	if ok {
+		// stick to the node which answered
+		atomic.StoreInt32(&cl.node, int32(node))
+	}
+	if cl.breaker.record(trial, ok) {
+		logger.Error("circuit breaker open",
+			zap.String("cluster", cl.label()),
+			zap.Int("failures", cl.conf.BreakerFailures),
+		)
+	}
+	if cl.breaker != nil {
+		open := 0.0
+		if cl.breaker.open() {
+			open = 1
+		}
+		metrics.ClusterBreakerOpen.WithLabelValues(cl.label()).Set(open)
+	}
+	return status, respBody, err
+}
+
+// ping sends a single GET of path to the current node. It bypasses the
+// limits, retries and breaker, a probe is neither held back by the alerts
+// nor counted as one of their failures
+func (cl *cluster) ping(ctx context.Context, path string) error {
+	node := int(atomic.LoadInt32(&cl.node))
+	status, _, err := cl.send(ctx, "GET", cl.url(node, path), nil)
+	if err == nil && status != 200 {
+		err = fmt.Errorf("HTTP status code: %v", status)
+	}
+	return err
+}
+
+// send performs a single attempt of request against u
+func (cl *cluster) send(ctx context.Context, method, u string, body []byte) (int, []byte, error) {
+	fields := []zap.Field{
+		zap.String("method", method),
+		zap.String("url", u),
+	}
+	if logger.Verbose() && body != nil {
+		fields = append(fields, zap.ByteString("body", redact.JSON(body)))
+	}
+	logger.Debug("search build request", fields...)
+
+	req, err := http.NewRequest(method, u, bytes.NewBuffer(body))
+	if err != nil {
+		return 0, nil, err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Add("Accept", "application/json")
+	req.Header.Set("Content-Type", "application/json")
+	tracing.Inject(ctx, req.Header)
+	if id := tracing.TraceID(ctx); id != "" {
+		// shows up in elasticsearch slow logs and tasks
+		req.Header.Set("X-Opaque-Id", id)
+	}
+	cl.authorize(req)
+
+	start := time.Now()
+	resp, err := cl.client.Do(req)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer resp.Body.Close()
+
+	respBody, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return 0, nil, err
+	}
+	metrics.SearchDuration.WithLabelValues(req.URL.Host).Observe(time.Since(start).Seconds())
+
+	fields = []zap.Field{
+		zap.Int("status", resp.StatusCode),
+		zap.Int("size", len(respBody)),
+	}
+	if logger.Verbose() {
+		fields = append(fields, zap.ByteString("body", redact.JSON(respBody)))
+	}
+	logger.Debug("search results", fields...)
+
+	return resp.StatusCode, respBody, nil
+}
@@ -0,0 +1,61 @@
+package alert
+
+import (
+	"context"
+
+	"github.com/koding/multiconfig"
+
+	"github.com/CheerChen/esalert/redact"
+	"github.com/CheerChen/esalert/tenant"
+)
+
+type ServerConf struct {
+	Elastic ElasticConf
+	Cluster map[string]ClusterConf
+	Tenant  map[string]TenantConf
+	Policy  PolicyConf
+}
+
+// TenantConf holds the search settings of a single tenant, see
+// [Tenant.<name>.Elastic] and [Tenant.<name>.Cluster.<cluster>]
+type TenantConf struct {
+	Elastic ElasticConf
+	Cluster map[string]ClusterConf
+}
+
+// ElasticConf holds the credentials sent along with every search_url search
+type ElasticConf struct {
+	User string
+	Pass string
+}
+
+var conf = new(ServerConf)
+
+func Load(loader *multiconfig.DefaultLoader) error {
+	conf = new(ServerConf)
+	loader.MustLoad(conf)
+
+	redact.Secret(conf.Elastic.Pass)
+	for _, t := range conf.Tenant {
+		redact.Secret(t.Elastic.Pass)
+	}
+	return loadClusters(conf)
+}
+
+// elasticConfFor returns the search credentials of the tenant running ctx.
+// Credentials a tenant leaves empty are taken from the global [Elastic]
+// section
+func elasticConfFor(ctx context.Context) ElasticConf {
+	ec := conf.Elastic
+	t, ok := conf.Tenant[tenant.FromContext(ctx)]
+	if !ok {
+		return ec
+	}
+	if t.Elastic.User != "" {
+		ec.User = t.Elastic.User
+	}
+	if t.Elastic.Pass != "" {
+		ec.Pass = t.Elastic.Pass
+	}
+	return ec
+}
@@ -0,0 +1,220 @@
+package alert
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"html/template"
+	"io"
+	"net/url"
+	"strings"
+	texttemplate "text/template"
+
+	"github.com/mitchellh/mapstructure"
+	"go.uber.org/zap"
+	"gopkg.in/yaml.v2"
+
+	"github.com/CheerChen/esalert/logger"
+	"github.com/CheerChen/esalert/tenant"
+	"github.com/CheerChen/esalert/tracing"
+)
+
+// Inputer describes an input type. Every input fetches the data an alert
+// looks at, and returns it as a Result so the process step sees the same ctx
+// whatever the input: searches fill the hits and aggregations, other inputs
+// the Payload
+type Inputer interface {
+	// Init checks the definition and parses its templates, tenant owns the
+	// alert
+	Init(tenant string) error
+	// Fetch renders the templates of the input against c and fetches the data
+	Fetch(ctx context.Context, c Context) (Result, error)
+}
+
+// Renderer is implemented by the inputs which send a query to
+// elasticsearch, Render returns the request body for c
+type Renderer interface {
+	Render(c Context) (interface{}, error)
+}
+
+// Input is a wrapper around an Inputer which contains some type information
+type Input struct {
+	Type string
+	Inputer
+}
+
+// ToInputer looks at the "type" key of an input definition, and decodes the
+// other fields into the matching Inputer
+func ToInputer(in Dict) (Input, error) {
+	var i Inputer
+	typ, _ := in["type"].(string)
+	typ = strings.ToLower(typ)
+	switch typ {
+	case "search":
+		i = &SearchInput{}
+	case "count":
+		i = &CountInput{}
+	case "es_sql":
+		i = &SQLQueryInput{}
+	case "eql":
+		i = &EQLInput{}
+	case "cat":
+		i = &CatInput{}
+	case "cluster":
+		i = &ClusterInput{}
+	case "sql":
+		i = &SQLInput{}
+	case "prometheus":
+		i = &PrometheusInput{}
+	case "http":
+		i = &HTTPInput{}
+	case "static":
+		i = &StaticInput{}
+	default:
+		return Input{}, fmt.Errorf("unknown input type: %q", typ)
+	}
+
+	if err := mapstructure.Decode(map[string]interface{}(in), i); err != nil {
+		return Input{}, err
+	}
+	return Input{Type: typ, Inputer: i}, nil
+}
+
+// renderError marks failures to render the templates of an input, the run
+// then stops at the "query" step rather than "search"
+type renderError struct {
+	error
+}
+
+// templateFuncs are the functions every template can call, pathEscape and
+// queryEscape quote values put into urls
+var templateFuncs = map[string]interface{}{
+	"pathEscape":  url.PathEscape,
+	"queryEscape": url.QueryEscape,
+}
+
+// templateSource returns the text of a template given as a string, or as a
+// value marshalled to yaml
+func templateSource(i interface{}) (string, error) {
+	if s, ok := i.(string); ok {
+		return s, nil
+	}
+	b, err := yaml.Marshal(i)
+	if err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
+
+func templateHelper(i interface{}, lastErr error) (*template.Template, error) {
+	if lastErr != nil {
+		return nil, lastErr
+	}
+	str, err := templateSource(i)
+	if err != nil {
+		return nil, err
+	}
+	return template.New("").Funcs(templateFuncs).Parse(str)
+}
+
+// textTemplate parses a template which is rendered as is, unlike
+// templateHelper nothing is html escaped. Queries, urls and request bodies
+// which aren't html use it
+func textTemplate(i interface{}, lastErr error) (*texttemplate.Template, error) {
+	if lastErr != nil {
+		return nil, lastErr
+	}
+	str, err := templateSource(i)
+	if err != nil {
+		return nil, err
+	}
+	return texttemplate.New("").Funcs(templateFuncs).Parse(str)
+}
+
+// executor is a parsed html or text template
+type executor interface {
+	Execute(w io.Writer, data interface{}) error
+}
+
+// startRender traces the rendering of the templates of an input, end is
+// called with the rendering error
+func startRender(ctx context.Context) (end func(error)) {
+	_, span := tracing.Start(ctx, "render")
+	return func(err error) {
+		tracing.End(span, err)
+	}
+}
+
+// renderString executes tpl against c
+func renderString(tpl executor, c Context) (string, error) {
+	buf := bytes.NewBuffer(make([]byte, 0, 1024))
+	if err := tpl.Execute(buf, &c); err != nil {
+		return "", renderError{err}
+	}
+	return buf.String(), nil
+}
+
+// renderDict executes tpl against c and decodes the yaml document it
+// produces
+func renderDict(tpl executor, c Context) (Dict, error) {
+	raw, err := renderString(tpl, c)
+	if err != nil {
+		return nil, err
+	}
+	fields := []zap.Field{
+		zap.String("id", c.Name),
+	}
+	if logger.Verbose() {
+		fields = append(fields, zap.String("searchRaw", raw))
+	}
+	logger.Debug("create search query", fields...)
+
+	var d Dict
+	if err := yaml.Unmarshal([]byte(raw), &d); err != nil {
+		return nil, renderError{err}
+	}
+	return d, nil
+}
+
+// esTarget selects the elasticsearch cluster an input talks to, either a
+// configured cluster or the base url of a node, which is authenticated with
+// the [Elastic] credentials of the tenant
+type esTarget struct {
+	Cluster string `mapstructure:"cluster"`
+	URL     string `mapstructure:"url"`
+}
+
+func (t esTarget) init(tenantName string) error {
+	if t.Cluster != "" {
+		_, err := lookupCluster(tenantName, t.Cluster)
+		return err
+	}
+	if t.URL == "" {
+		return errors.New("either cluster or url is required")
+	}
+	return nil
+}
+
+// resolve returns the cluster and the path of the api endpoint p on it
+func (t esTarget) resolve(ctx context.Context, p string) (*cluster, string, error) {
+	if t.Cluster != "" {
+		cl, err := lookupCluster(tenant.FromContext(ctx), t.Cluster)
+		return cl, p, err
+	}
+	return adhocCluster(ctx), strings.TrimRight(t.URL, "/") + "/" + strings.TrimLeft(p, "/"), nil
+}
+
+// StaticInput hands a fixed payload to the process step, which is mostly
+// useful to try out processes and actions
+type StaticInput struct {
+	Payload interface{} `mapstructure:"payload"`
+}
+
+func (s *StaticInput) Init(tenant string) error {
+	return nil
+}
+
+func (s *StaticInput) Fetch(ctx context.Context, c Context) (Result, error) {
+	return Result{Payload: s.Payload}, nil
+}
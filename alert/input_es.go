@@ -0,0 +1,217 @@
+package alert
+
+import (
+	"context"
+	"errors"
+	"html/template"
+	"net/url"
+	"strings"
+)
+
+// SearchInput runs a search, the body is a template rendered against the
+// alert context. Alerts with a top level search/search_url or
+// cluster/index get one of these
+type SearchInput struct {
+	esTarget `mapstructure:",squash"`
+	Index    string `mapstructure:"index"`
+	Body     Dict   `mapstructure:"body"`
+	// TrackTotalHits is added to the body as track_total_hits unless the body
+	// sets it
+	TrackTotalHits interface{} `mapstructure:"track_total_hits"`
+	Paginate       *Paginate   `mapstructure:"paginate"`
+	// Query is compiled into the body when body is not set
+	Query `mapstructure:",squash"`
+
+	searchURL string // full search url of alerts with a top level search_url
+	tpl       *template.Template
+}
+
+func (s *SearchInput) Init(tenant string) error {
+	if s.Body == nil && !s.Query.Empty() {
+		body, err := s.Query.Compile()
+		if err != nil {
+			return err
+		}
+		s.Body = body
+	} else if s.Body != nil && !s.Query.Empty() {
+		return errors.New("body and timeframe, filter, group_by or metric cannot be used together")
+	}
+
+	var err error
+	if s.tpl, err = templateHelper(&s.Body, err); err != nil {
+		return err
+	}
+	if s.searchURL == "" {
+		if err := s.esTarget.init(tenant); err != nil {
+			return err
+		}
+		if s.Index == "" {
+			return errors.New("index is required")
+		}
+	}
+	if s.Paginate != nil {
+		return s.Paginate.init()
+	}
+	return nil
+}
+
+// Render returns the search body for c
+func (s *SearchInput) Render(c Context) (interface{}, error) {
+	return s.render(c)
+}
+
+func (s *SearchInput) render(c Context) (Dict, error) {
+	body, err := renderDict(s.tpl, c)
+	if err != nil {
+		return nil, err
+	}
+	if s.TrackTotalHits != nil {
+		if body == nil {
+			body = Dict{}
+		}
+		if _, ok := body["track_total_hits"]; !ok {
+			body["track_total_hits"] = s.TrackTotalHits
+		}
+	}
+	return body, nil
+}
+
+func (s *SearchInput) Fetch(ctx context.Context, c Context) (Result, error) {
+	end := startRender(ctx)
+	body, err := s.render(c)
+	end(err)
+	if err != nil {
+		return Result{}, err
+	}
+
+	cl, path := adhocCluster(ctx), s.searchURL
+	if path == "" {
+		if cl, path, err = s.resolve(ctx, s.Index+"/_search"); err != nil {
+			return Result{}, err
+		}
+	}
+	if s.Paginate != nil {
+		return s.Paginate.paginate(ctx, cl, path, body)
+	}
+	if s.searchURL != "" {
+		return search(ctx, cl, path, body)
+	}
+	return cl.search(ctx, s.Index, body)
+}
+
+// CountInput counts the documents matching a query with the _count api, the
+// count is the HitCount of the result
+type CountInput struct {
+	esTarget `mapstructure:",squash"`
+	Index    string `mapstructure:"index"`
+	Body     Dict   `mapstructure:"body"` // {"query": ...}, empty counts every document
+
+	tpl *template.Template
+}
+
+func (s *CountInput) Init(tenant string) error {
+	var err error
+	if s.tpl, err = templateHelper(&s.Body, err); err != nil {
+		return err
+	}
+	if err := s.esTarget.init(tenant); err != nil {
+		return err
+	}
+	if s.Index == "" {
+		return errors.New("index is required")
+	}
+	return nil
+}
+
+// Render returns the _count body for c, nil without a body
+func (s *CountInput) Render(c Context) (interface{}, error) {
+	if len(s.Body) == 0 {
+		return nil, nil
+	}
+	return renderDict(s.tpl, c)
+}
+
+func (s *CountInput) Fetch(ctx context.Context, c Context) (Result, error) {
+	end := startRender(ctx)
+	body, err := s.Render(c)
+	end(err)
+	if err != nil {
+		return Result{}, err
+	}
+	cl, path, err := s.resolve(ctx, s.Index+"/_count")
+	if err != nil {
+		return Result{}, err
+	}
+
+	var resp struct {
+		Count  uint64    `json:"count"`
+		Shards ShardInfo `json:"_shards"`
+	}
+	if err := cl.do(ctx, "POST", path, body, &resp); err != nil {
+		return Result{}, err
+	}
+	res := Result{Shards: resp.Shards}
+	res.HitCount, res.HitCountRelation = resp.Count, "eq"
+	return res, nil
+}
+
+// CatInput calls a _cat api, e.g. "indices" or "shards", with format=json.
+// The rows are the Payload of the result
+type CatInput struct {
+	esTarget `mapstructure:",squash"`
+	API      string            `mapstructure:"api"`
+	Params   map[string]string `mapstructure:"params"`
+}
+
+func (s *CatInput) Init(tenant string) error {
+	if s.API == "" {
+		return errors.New("api is required")
+	}
+	return s.esTarget.init(tenant)
+}
+
+func (s *CatInput) Fetch(ctx context.Context, c Context) (Result, error) {
+	params := map[string]string{"format": "json"}
+	for k, v := range s.Params {
+		params[k] = v
+	}
+	return getPayload(ctx, s.esTarget, "_cat/"+strings.Trim(s.API, "/"), params)
+}
+
+// ClusterInput calls a _cluster api, e.g. "health" or "stats". The response
+// is the Payload of the result
+type ClusterInput struct {
+	esTarget `mapstructure:",squash"`
+	API      string            `mapstructure:"api"`
+	Params   map[string]string `mapstructure:"params"`
+}
+
+func (s *ClusterInput) Init(tenant string) error {
+	if s.API == "" {
+		return errors.New("api is required")
+	}
+	return s.esTarget.init(tenant)
+}
+
+func (s *ClusterInput) Fetch(ctx context.Context, c Context) (Result, error) {
+	return getPayload(ctx, s.esTarget, "_cluster/"+strings.Trim(s.API, "/"), s.Params)
+}
+
+func getPayload(ctx context.Context, t esTarget, p string, params map[string]string) (Result, error) {
+	if len(params) > 0 {
+		q := url.Values{}
+		for k, v := range params {
+			q.Set(k, v)
+		}
+		p += "?" + q.Encode()
+	}
+	cl, path, err := t.resolve(ctx, p)
+	if err != nil {
+		return Result{}, err
+	}
+	var payload interface{}
+	if err := cl.do(ctx, "GET", path, nil, &payload); err != nil {
+		return Result{}, err
+	}
+	return Result{Payload: payload}, nil
+}
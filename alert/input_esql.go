@@ -0,0 +1,205 @@
+package alert
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/url"
+	"strings"
+	"text/template"
+)
+
+// Table is the result of an elasticsearch sql query
+type Table struct {
+	Columns []string
+	Rows    []map[string]interface{} // keyed by column
+}
+
+// SQLQueryInput runs an elasticsearch sql query with the _sql api and
+// format=json. The statement is a template rendered against the alert
+// context, and the columns and rows are ctx.Table
+type SQLQueryInput struct {
+	esTarget  `mapstructure:",squash"`
+	Query     string `mapstructure:"query"`
+	FetchSize int    `mapstructure:"fetch_size"` // rows returned, default 1000
+	TimeZone  string `mapstructure:"time_zone"`
+
+	tpl *template.Template
+}
+
+func (s *SQLQueryInput) Init(tenant string) error {
+	if s.Query == "" {
+		return errors.New("query is required")
+	}
+	if s.FetchSize == 0 {
+		s.FetchSize = 1000
+	}
+	if err := s.esTarget.init(tenant); err != nil {
+		return err
+	}
+	var err error
+	s.tpl, err = textTemplate(s.Query, err)
+	return err
+}
+
+// Render returns the _sql request body for c
+func (s *SQLQueryInput) Render(c Context) (interface{}, error) {
+	query, err := renderString(s.tpl, c)
+	if err != nil {
+		return nil, err
+	}
+	body := Dict{
+		"query":      strings.TrimSpace(query),
+		"fetch_size": s.FetchSize,
+	}
+	if s.TimeZone != "" {
+		body["time_zone"] = s.TimeZone
+	}
+	return body, nil
+}
+
+func (s *SQLQueryInput) Fetch(ctx context.Context, c Context) (Result, error) {
+	end := startRender(ctx)
+	body, err := s.Render(c)
+	end(err)
+	if err != nil {
+		return Result{}, err
+	}
+	cl, path, err := s.resolve(ctx, "_sql?format=json")
+	if err != nil {
+		return Result{}, err
+	}
+
+	var resp struct {
+		Columns []struct {
+			Name string `json:"name"`
+			Type string `json:"type"`
+		} `json:"columns"`
+		Rows   [][]interface{} `json:"rows"`
+		Cursor string          `json:"cursor"`
+	}
+	if err := cl.do(ctx, "POST", path, body, &resp); err != nil {
+		return Result{}, err
+	}
+	if resp.Cursor != "" {
+		// only the first fetch_size rows are used
+		closePath := cl.rootPath(path, "_sql/close")
+		if err := cl.do(ctx, "POST", closePath, Dict{"cursor": resp.Cursor}, nil); err != nil {
+			return Result{}, err
+		}
+	}
+
+	var res Result
+	res.Table.Columns = make([]string, len(resp.Columns))
+	for i, col := range resp.Columns {
+		res.Table.Columns[i] = col.Name
+	}
+	res.Table.Rows = make([]map[string]interface{}, len(resp.Rows))
+	for i, row := range resp.Rows {
+		m := make(map[string]interface{}, len(row))
+		for j, v := range row {
+			if j < len(res.Table.Columns) {
+				m[res.Table.Columns[j]] = v
+			}
+		}
+		res.Table.Rows[i] = m
+	}
+	res.HitCount, res.HitCountRelation = uint64(len(resp.Rows)), "eq"
+	if resp.Cursor != "" {
+		res.HitCountRelation = "gte"
+		res.HitsTruncated = true
+	}
+	return res, nil
+}
+
+// Sequence is a matched eql sequence
+type Sequence struct {
+	JoinKeys []interface{} `json:"join_keys"`
+	Events   []Hit         `json:"events"`
+}
+
+// EQLInput runs an event query language search with the _eql api. Query is
+// either the eql statement or a full request body, a template rendered
+// against the alert context. Matched events are ctx.Hits, matched sequences
+// ctx.Sequences
+type EQLInput struct {
+	esTarget `mapstructure:",squash"`
+	Index    string      `mapstructure:"index"`
+	Query    interface{} `mapstructure:"query"`
+
+	tpl *template.Template
+}
+
+func (s *EQLInput) Init(tenant string) error {
+	if s.Query == nil {
+		return errors.New("query is required")
+	}
+	if err := s.esTarget.init(tenant); err != nil {
+		return err
+	}
+	if s.Index == "" {
+		return errors.New("index is required")
+	}
+	var err error
+	s.tpl, err = textTemplate(s.Query, err)
+	return err
+}
+
+// Render returns the _eql/search request body for c
+func (s *EQLInput) Render(c Context) (interface{}, error) {
+	if _, ok := s.Query.(string); ok {
+		query, err := renderString(s.tpl, c)
+		if err != nil {
+			return nil, err
+		}
+		return Dict{"query": strings.TrimSpace(query)}, nil
+	}
+	return renderDict(s.tpl, c)
+}
+
+func (s *EQLInput) Fetch(ctx context.Context, c Context) (Result, error) {
+	end := startRender(ctx)
+	body, err := s.Render(c)
+	end(err)
+	if err != nil {
+		return Result{}, err
+	}
+	cl, path, err := s.resolve(ctx, s.Index+"/_eql/search")
+	if err != nil {
+		return Result{}, err
+	}
+
+	var raw json.RawMessage
+	if err := cl.do(ctx, "POST", path, body, &raw); err != nil {
+		return Result{}, err
+	}
+	// took, timed_out and hits.total come in the same shapes as for searches
+	var res Result
+	if err := json.Unmarshal(raw, &res); err != nil {
+		return Result{}, err
+	}
+	var resp struct {
+		Hits struct {
+			Events    []Hit      `json:"events"`
+			Sequences []Sequence `json:"sequences"`
+		} `json:"hits"`
+	}
+	if err := json.Unmarshal(raw, &resp); err != nil {
+		return Result{}, err
+	}
+	res.Hits = resp.Hits.Events
+	res.Sequences = resp.Hits.Sequences
+	if res.TimedOut {
+		return res, errors.New("query timed out in elastic query")
+	}
+	return res, nil
+}
+
+// nodeURL returns the base url of the node of a search_url
+func nodeURL(searchURL string) string {
+	u, err := url.Parse(searchURL)
+	if err != nil {
+		return searchURL
+	}
+	return u.Scheme + "://" + u.Host
+}
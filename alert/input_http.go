@@ -0,0 +1,109 @@
+package alert
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/CheerChen/esalert/tracing"
+)
+
+var httpInputClient = &http.Client{
+	Timeout: time.Duration(10 * time.Second),
+}
+
+// HTTPInput calls an arbitrary json api. The url and body are templates
+// rendered against the alert context, values put into the url are quoted
+// with pathEscape or queryEscape, e.g. ?q={{queryEscape .Name}}. The decoded
+// response is the Payload of the result
+type HTTPInput struct {
+	Method  string            `mapstructure:"method"` // default GET
+	URL     string            `mapstructure:"url"`
+	Headers map[string]string `mapstructure:"headers"`
+	Body    interface{}       `mapstructure:"body"` // sent as json, a string is sent as is
+
+	urlTPL  *template.Template
+	bodyTPL *template.Template
+}
+
+func (h *HTTPInput) Init(tenant string) error {
+	if h.URL == "" {
+		return errors.New("url is required")
+	}
+	if h.Method == "" {
+		h.Method = "GET"
+	}
+	var err error
+	h.urlTPL, err = textTemplate(h.URL, err)
+	if h.Body != nil {
+		h.bodyTPL, err = textTemplate(h.Body, err)
+	}
+	return err
+}
+
+// render returns the url and the body of the request for c
+func (h *HTTPInput) render(c Context) (string, []byte, error) {
+	u, err := renderString(h.urlTPL, c)
+	if err != nil || h.bodyTPL == nil {
+		return u, nil, err
+	}
+	if _, ok := h.Body.(string); ok {
+		raw, err := renderString(h.bodyTPL, c)
+		return u, []byte(raw), err
+	}
+	d, err := renderDict(h.bodyTPL, c)
+	if err != nil {
+		return u, nil, err
+	}
+	body, err := json.Marshal(d)
+	return u, body, err
+}
+
+func (h *HTTPInput) Fetch(ctx context.Context, c Context) (Result, error) {
+	end := startRender(ctx)
+	u, body, err := h.render(c)
+	end(err)
+	if err != nil {
+		return Result{}, err
+	}
+
+	r, err := http.NewRequest(h.Method, strings.TrimSpace(u), bytes.NewBuffer(body))
+	if err != nil {
+		return Result{}, err
+	}
+	r = r.WithContext(ctx)
+	tracing.Inject(ctx, r.Header)
+	r.Header.Set("Accept", "application/json")
+	if body != nil {
+		r.Header.Set("Content-Type", "application/json")
+	}
+	for k, v := range h.Headers {
+		r.Header.Set(k, v)
+	}
+
+	resp, err := httpInputClient.Do(r)
+	if err != nil {
+		return Result{}, err
+	}
+	defer resp.Body.Close()
+	respBody, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return Result{}, err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return Result{}, fmt.Errorf("non 2xx response code returned: %d", resp.StatusCode)
+	}
+
+	var payload interface{}
+	if err := json.Unmarshal(respBody, &payload); err != nil {
+		return Result{}, err
+	}
+	return Result{Payload: payload}, nil
+}
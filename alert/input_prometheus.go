@@ -0,0 +1,232 @@
+package alert
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/CheerChen/esalert/tracing"
+)
+
+// Sample is a single value of a prometheus series
+type Sample struct {
+	Time  float64 // unix seconds
+	Value float64
+}
+
+// Series is one series of a prometheus query result. Vectors have a single
+// sample, matrices one per step, Value is always the latest one
+type Series struct {
+	Labels  map[string]string
+	Samples []Sample
+	Value   float64
+}
+
+// PrometheusInput evaluates a PromQL expression with the prometheus http api,
+// an instant query or, with range set, a range query. The expression is a
+// template rendered against the alert context. Series are ctx.Series, and
+// HitCount is their number
+type PrometheusInput struct {
+	URL     string            `mapstructure:"url"` // e.g. http://127.0.0.1:9090
+	Query   string            `mapstructure:"query"`
+	Range   string            `mapstructure:"range"` // e.g. "1h", query_range up to now
+	Step    string            `mapstructure:"step"`  // of the range query, default "1m"
+	Timeout string            `mapstructure:"timeout"`
+	Headers map[string]string `mapstructure:"headers"`
+
+	rng, step time.Duration
+	tpl       *template.Template
+}
+
+var promClient = &http.Client{
+	Timeout: time.Duration(10 * time.Second),
+}
+
+func (p *PrometheusInput) Init(tenant string) error {
+	if p.URL == "" {
+		return errors.New("url is required")
+	}
+	if p.Query == "" {
+		return errors.New("query is required")
+	}
+	var err error
+	if p.Range != "" {
+		if p.rng, err = time.ParseDuration(p.Range); err != nil {
+			return fmt.Errorf("range: %s", err)
+		}
+		if p.Step == "" {
+			p.Step = "1m"
+		}
+		if p.step, err = time.ParseDuration(p.Step); err != nil {
+			return fmt.Errorf("step: %s", err)
+		}
+		if p.step <= 0 || p.rng/p.step > 11000 {
+			return errors.New("range has more than 11000 steps")
+		}
+	}
+	if p.Timeout != "" {
+		if _, err = time.ParseDuration(p.Timeout); err != nil {
+			return fmt.Errorf("timeout: %s", err)
+		}
+	}
+	p.tpl, err = textTemplate(p.Query, err)
+	return err
+}
+
+type promResponse struct {
+	Status    string `json:"status"`
+	ErrorType string `json:"errorType"`
+	Error     string `json:"error"`
+	Data      struct {
+		ResultType string          `json:"resultType"`
+		Result     json.RawMessage `json:"result"`
+	} `json:"data"`
+}
+
+func (p *PrometheusInput) Fetch(ctx context.Context, c Context) (Result, error) {
+	end := startRender(ctx)
+	query, err := renderString(p.tpl, c)
+	end(err)
+	if err != nil {
+		return Result{}, err
+	}
+
+	now := c.Time
+	if now.IsZero() {
+		now = time.Now()
+	}
+	form := url.Values{}
+	form.Set("query", strings.TrimSpace(query))
+	endpoint := "/api/v1/query"
+	if p.rng > 0 {
+		endpoint = "/api/v1/query_range"
+		form.Set("start", formatPromTime(now.Add(-p.rng)))
+		form.Set("end", formatPromTime(now))
+		form.Set("step", strconv.FormatFloat(p.step.Seconds(), 'f', -1, 64))
+	} else {
+		form.Set("time", formatPromTime(now))
+	}
+	if p.Timeout != "" {
+		form.Set("timeout", p.Timeout)
+	}
+
+	req, err := http.NewRequest("POST", strings.TrimRight(p.URL, "/")+endpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return Result{}, err
+	}
+	req = req.WithContext(ctx)
+	tracing.Inject(ctx, req.Header)
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	for k, v := range p.Headers {
+		req.Header.Set(k, v)
+	}
+
+	start := time.Now()
+	resp, err := promClient.Do(req)
+	if err != nil {
+		return Result{}, err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return Result{}, err
+	}
+
+	var pr promResponse
+	if err := json.Unmarshal(body, &pr); err != nil {
+		return Result{}, fmt.Errorf("HTTP status code: %v", resp.StatusCode)
+	}
+	if pr.Status != "success" {
+		return Result{}, fmt.Errorf("prometheus %s: %s", pr.ErrorType, pr.Error)
+	}
+
+	series, err := decodePromResult(pr.Data.ResultType, pr.Data.Result)
+	if err != nil {
+		return Result{}, err
+	}
+	var res Result
+	res.TookMS = uint64(time.Since(start) / time.Millisecond)
+	res.Series = series
+	res.SeriesType = pr.Data.ResultType
+	res.HitCount, res.HitCountRelation = uint64(len(series)), "eq"
+	return res, nil
+}
+
+func formatPromTime(t time.Time) string {
+	return strconv.FormatFloat(float64(t.UnixNano())/1e9, 'f', 3, 64)
+}
+
+// decodePromResult turns vector, matrix and scalar results into series.
+// Sample values are sent as strings, "NaN" and "+Inf" included
+func decodePromResult(typ string, raw json.RawMessage) ([]Series, error) {
+	type point [2]interface{}
+	toSample := func(p point) (Sample, error) {
+		t, _ := p[0].(float64)
+		s, _ := p[1].(string)
+		v, err := strconv.ParseFloat(s, 64)
+		return Sample{Time: t, Value: v}, err
+	}
+
+	switch typ {
+	case "vector":
+		var items []struct {
+			Metric map[string]string `json:"metric"`
+			Value  point             `json:"value"`
+		}
+		if err := json.Unmarshal(raw, &items); err != nil {
+			return nil, err
+		}
+		series := make([]Series, len(items))
+		for i, it := range items {
+			smp, err := toSample(it.Value)
+			if err != nil {
+				return nil, err
+			}
+			series[i] = Series{Labels: it.Metric, Samples: []Sample{smp}, Value: smp.Value}
+		}
+		return series, nil
+
+	case "matrix":
+		var items []struct {
+			Metric map[string]string `json:"metric"`
+			Values []point           `json:"values"`
+		}
+		if err := json.Unmarshal(raw, &items); err != nil {
+			return nil, err
+		}
+		series := make([]Series, len(items))
+		for i, it := range items {
+			s := Series{Labels: it.Metric, Samples: make([]Sample, len(it.Values))}
+			for j, p := range it.Values {
+				smp, err := toSample(p)
+				if err != nil {
+					return nil, err
+				}
+				s.Samples[j] = smp
+				s.Value = smp.Value
+			}
+			series[i] = s
+		}
+		return series, nil
+
+	case "scalar":
+		var p point
+		if err := json.Unmarshal(raw, &p); err != nil {
+			return nil, err
+		}
+		smp, err := toSample(p)
+		if err != nil {
+			return nil, err
+		}
+		return []Series{{Labels: map[string]string{}, Samples: []Sample{smp}, Value: smp.Value}}, nil
+	}
+	return nil, fmt.Errorf("unsupported prometheus result type: %q", typ)
+}
@@ -0,0 +1,163 @@
+package alert
+
+import (
+	"context"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPrometheusInputFetch(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	tests := []struct {
+		name     string
+		query    string
+		rng      string
+		status   int
+		body     string
+		endpoint string
+		params   map[string]string
+		typ      string
+		series   []Series
+		err      string
+	}{
+		{
+			name:     "instant vector",
+			status:   200,
+			body:     `{"status":"success","data":{"resultType":"vector","result":[{"metric":{"job":"api"},"value":[1700000000,"0.5"]},{"metric":{"job":"web"},"value":[1700000000,"NaN"]}]}}`,
+			endpoint: "/api/v1/query",
+			params:   map[string]string{"query": "up", "time": "1700000000.000"},
+			typ:      "vector",
+			series: []Series{
+				{Labels: map[string]string{"job": "api"}, Samples: []Sample{{1700000000, 0.5}}, Value: 0.5},
+				{Labels: map[string]string{"job": "web"}, Samples: []Sample{{1700000000, math.NaN()}}, Value: math.NaN()},
+			},
+		},
+		{
+			name:     "range matrix",
+			rng:      "2m",
+			status:   200,
+			body:     `{"status":"success","data":{"resultType":"matrix","result":[{"metric":{"job":"api"},"values":[[1699999880,"1"],[1699999940,"2"],[1700000000,"+Inf"]]}]}}`,
+			endpoint: "/api/v1/query_range",
+			params:   map[string]string{"query": "up", "start": "1699999880.000", "end": "1700000000.000", "step": "60"},
+			typ:      "matrix",
+			series: []Series{{
+				Labels:  map[string]string{"job": "api"},
+				Samples: []Sample{{1699999880, 1}, {1699999940, 2}, {1700000000, math.Inf(1)}},
+				Value:   math.Inf(1),
+			}},
+		},
+		{
+			name:     "template values sent as is",
+			query:    `rate(x{path="{{.Payload.path}}"}[5m])<{{.Payload.n}}`,
+			status:   200,
+			body:     `{"status":"success","data":{"resultType":"vector","result":[]}}`,
+			endpoint: "/api/v1/query",
+			params:   map[string]string{"query": `rate(x{path="/a&b'c"}[5m])<3`},
+			typ:      "vector",
+			series:   []Series{},
+		},
+		{
+			name:     "scalar",
+			status:   200,
+			body:     `{"status":"success","data":{"resultType":"scalar","result":[1700000000,"42"]}}`,
+			endpoint: "/api/v1/query",
+			typ:      "scalar",
+			series:   []Series{{Labels: map[string]string{}, Samples: []Sample{{1700000000, 42}}, Value: 42}},
+		},
+		{
+			name:     "bad query",
+			status:   400,
+			body:     `{"status":"error","errorType":"bad_data","error":"parse error at char 3"}`,
+			endpoint: "/api/v1/query",
+			err:      "prometheus bad_data: parse error at char 3",
+		},
+		{
+			name:     "proxy error page",
+			status:   502,
+			body:     "<html>Bad Gateway</html>",
+			endpoint: "/api/v1/query",
+			err:      "HTTP status code: 502",
+		},
+		{
+			name:     "unsupported result type",
+			status:   200,
+			body:     `{"status":"success","data":{"resultType":"string","result":[1700000000,"x"]}}`,
+			endpoint: "/api/v1/query",
+			err:      `unsupported prometheus result type: "string"`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.URL.Path != tt.endpoint {
+					t.Errorf("path = %s, want %s", r.URL.Path, tt.endpoint)
+				}
+				if got := r.Header.Get("X-Scope-OrgID"); got != "team-a" {
+					t.Errorf("X-Scope-OrgID = %q, want team-a", got)
+				}
+				for k, want := range tt.params {
+					if got := r.FormValue(k); got != want {
+						t.Errorf("%s = %q, want %q", k, got, want)
+					}
+				}
+				w.WriteHeader(tt.status)
+				w.Write([]byte(tt.body))
+			}))
+			defer srv.Close()
+
+			query := tt.query
+			if query == "" {
+				query = " up "
+			}
+			p := &PrometheusInput{URL: srv.URL + "/", Query: query, Range: tt.rng, Headers: map[string]string{"X-Scope-OrgID": "team-a"}}
+			if err := p.Init(""); err != nil {
+				t.Fatal(err)
+			}
+			c := Context{Time: now}
+			c.Payload = map[string]interface{}{"path": "/a&b'c", "n": 3}
+			res, err := p.Fetch(context.Background(), c)
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("error = %v, want %q", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if res.SeriesType != tt.typ || res.HitCount != uint64(len(tt.series)) {
+				t.Errorf("type %q with %d series, want %q with %d", res.SeriesType, res.HitCount, tt.typ, len(tt.series))
+			}
+			if !seriesEqual(res.Series, tt.series) {
+				t.Errorf("series = %+v, want %+v", res.Series, tt.series)
+			}
+		})
+	}
+}
+
+// seriesEqual compares series with NaN samples equal to each other
+func seriesEqual(a, b []Series) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	same := func(x, y float64) bool {
+		return x == y || (math.IsNaN(x) && math.IsNaN(y))
+	}
+	for i := range a {
+		if !reflect.DeepEqual(a[i].Labels, b[i].Labels) || !same(a[i].Value, b[i].Value) || len(a[i].Samples) != len(b[i].Samples) {
+			return false
+		}
+		for j, s := range a[i].Samples {
+			if s.Time != b[i].Samples[j].Time || !same(s.Value, b[i].Samples[j].Value) {
+				return false
+			}
+		}
+	}
+	return true
+}
@@ -0,0 +1,76 @@
+package alert
+
+import (
+	"context"
+	"errors"
+	"text/template"
+	"time"
+
+	"github.com/CheerChen/esalert/models"
+	"github.com/CheerChen/esalert/tenant"
+)
+
+// SQLInput runs a read-only query against a configured datasource, the
+// query is a template rendered against the alert context. Rows are exposed
+// like hits, ctx.Hits[i].Source.<column>, and HitCount is the number of rows
+type SQLInput struct {
+	Datasource string `mapstructure:"datasource"`
+	Query      string `mapstructure:"query"`
+	Timeout    string `mapstructure:"timeout"`  // capped by the datasource Timeout
+	MaxRows    int    `mapstructure:"max_rows"` // capped by the datasource MaxRows
+
+	timeout time.Duration
+	tpl     *template.Template
+}
+
+func (s *SQLInput) Init(tenantName string) error {
+	if tenantName == "" {
+		tenantName = tenant.Default
+	}
+	if _, err := models.GetDatasource(s.Datasource, tenantName); err != nil {
+		return err
+	}
+	if s.Query == "" {
+		return errors.New("query is required")
+	}
+	if s.Timeout != "" {
+		var err error
+		if s.timeout, err = time.ParseDuration(s.Timeout); err != nil {
+			return err
+		}
+	}
+	var err error
+	s.tpl, err = textTemplate(s.Query, err)
+	return err
+}
+
+func (s *SQLInput) Fetch(ctx context.Context, c Context) (Result, error) {
+	end := startRender(ctx)
+	query, err := renderString(s.tpl, c)
+	end(err)
+	if err != nil {
+		return Result{}, err
+	}
+	if err := models.CheckReadOnly(query); err != nil {
+		return Result{}, err
+	}
+
+	start := time.Now()
+	rows, truncated, err := models.QueryDatasource(ctx, s.Datasource, tenant.FromContext(ctx), query, s.MaxRows, s.timeout)
+	if err != nil {
+		return Result{}, err
+	}
+
+	var res Result
+	res.TookMS = uint64(time.Since(start) / time.Millisecond)
+	res.Hits = make([]Hit, len(rows))
+	for i, row := range rows {
+		res.Hits[i] = Hit{Source: row}
+	}
+	res.HitCount, res.HitCountRelation = uint64(len(rows)), "eq"
+	if truncated {
+		res.HitCountRelation = "gte"
+	}
+	res.HitsTruncated = truncated
+	return res, nil
+}
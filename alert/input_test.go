@@ -0,0 +1,100 @@
+package alert
+
+import "testing"
+
+func TestHTTPInputRender(t *testing.T) {
+	tests := []struct {
+		name string
+		url  string
+		body interface{}
+		want string
+		raw  string
+	}{
+		{
+			name: "query value",
+			url:  "http://api/items?q={{queryEscape .Payload.q}}&n=1",
+			want: "http://api/items?q=a%26b%27c+%3C3&n=1",
+		},
+		{
+			name: "path value",
+			url:  "http://api/items/{{pathEscape .Payload.q}}",
+			want: "http://api/items/a&b%27c%20%3C3",
+		},
+		{
+			name: "body sent as is",
+			url:  "http://api/items",
+			body: `{"q": "{{.Payload.q}}", "lt": 5<{{.Payload.n}}}`,
+			want: "http://api/items",
+			raw:  `{"q": "a&b'c <3", "lt": 5<3}`,
+		},
+	}
+
+	c := Context{Result: Result{Payload: map[string]interface{}{"q": "a&b'c <3", "n": 3}}}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := &HTTPInput{URL: tt.url, Body: tt.body}
+			if err := h.Init(""); err != nil {
+				t.Fatal(err)
+			}
+			u, body, err := h.render(c)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if u != tt.want || string(body) != tt.raw {
+				t.Errorf("render = %q %q, want %q %q", u, body, tt.want, tt.raw)
+			}
+		})
+	}
+}
+
+func TestSQLInputTemplate(t *testing.T) {
+	// Init needs a datasource, the template is parsed the same way
+	s := &SQLInput{Query: `SELECT * FROM logs WHERE host = '{{.Payload.h}}' AND lvl<{{.Payload.n}} AND ok>{{.Payload.n}}`}
+	var err error
+	if s.tpl, err = textTemplate(s.Query, err); err != nil {
+		t.Fatal(err)
+	}
+	c := Context{Result: Result{Payload: map[string]interface{}{"h": "a&b'c", "n": 3}}}
+	query, err := renderString(s.tpl, c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := `SELECT * FROM logs WHERE host = 'a&b'c' AND lvl<3 AND ok>3`; query != want {
+		t.Errorf("query = %q, want %q", query, want)
+	}
+}
+
+func TestESQueryTemplates(t *testing.T) {
+	c := Context{Result: Result{Payload: map[string]interface{}{"h": "a&b'c", "n": 3}}}
+	tests := []struct {
+		name  string
+		input Renderer
+		want  string
+	}{
+		{
+			name:  "sql",
+			input: &SQLQueryInput{esTarget: esTarget{URL: "http://es"}, Query: `SELECT * FROM logs WHERE host = '{{.Payload.h}}' AND status<{{.Payload.n}}`},
+			want:  `SELECT * FROM logs WHERE host = 'a&b'c' AND status<3`,
+		},
+		{
+			name:  "eql statement",
+			input: &EQLInput{esTarget: esTarget{URL: "http://es"}, Index: "logs", Query: `process where process.name == "{{.Payload.h}}" and pid<{{.Payload.n}}`},
+			want:  `process where process.name == "a&b'c" and pid<3`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.input.(Inputer).Init(""); err != nil {
+				t.Fatal(err)
+			}
+			body, err := tt.input.Render(c)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := body.(Dict)["query"]; got != tt.want {
+				t.Errorf("query = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,263 @@
+package alert
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/CheerChen/esalert/metrics"
+	"github.com/CheerChen/esalert/tenant"
+)
+
+// ErrRateLimited is returned when a request waited QueueTimeout for the rate
+// limits of its cluster without being let through
+var ErrRateLimited = errors.New("rate limited")
+
+// ClusterLimits protect a cluster from bursts of searches, zero means
+// unlimited
+type ClusterLimits struct {
+	RateLimit     float64 `json:"rate_limit"`     // requests per second
+	RateBurst     int     `json:"rate_burst"`     // requests let through at once after a quiet period, default max(1, RateLimit)
+	MaxConcurrent int     `json:"max_concurrent"` // requests in flight
+	QueueTimeout  string  `json:"queue_timeout"`  // how long a request may wait for the limits, default "10s"
+}
+
+// ClusterLimitStatus is the current use of the limits of a cluster
+type ClusterLimitStatus struct {
+	ClusterLimits
+	Inflight int `json:"inflight"`
+	Queued   int `json:"queued"`
+}
+
+func (l ClusterLimits) withDefaults() ClusterLimits {
+	if l.RateBurst == 0 {
+		l.RateBurst = int(l.RateLimit)
+		if l.RateBurst < 1 {
+			l.RateBurst = 1
+		}
+	}
+	if l.QueueTimeout == "" {
+		l.QueueTimeout = "10s"
+	}
+	return l
+}
+
+func (l ClusterLimits) validate() (time.Duration, error) {
+	if l.RateLimit < 0 || l.RateBurst < 0 || l.MaxConcurrent < 0 {
+		return 0, errors.New("limits must not be negative")
+	}
+	timeout, err := time.ParseDuration(l.QueueTimeout)
+	if err != nil {
+		return 0, fmt.Errorf("QueueTimeout: %s", err)
+	}
+	return timeout, nil
+}
+
+// limiter is a token bucket of RateLimit requests per second along with at
+// most MaxConcurrent requests in flight. A nil limiter lets every request
+// through
+type limiter struct {
+	label string
+
+	mu       sync.Mutex
+	limits   ClusterLimits
+	timeout  time.Duration
+	tokens   float64
+	last     time.Time
+	inflight int
+	queued   int
+	wake     chan struct{} // closed when a request finishes or the limits change
+}
+
+func newLimiter(label string, l ClusterLimits) (*limiter, error) {
+	lim := &limiter{label: label, wake: make(chan struct{})}
+	if err := lim.set(l); err != nil {
+		return nil, err
+	}
+	return lim, nil
+}
+
+// set replaces the limits, waiting requests are checked against them at once
+func (lim *limiter) set(l ClusterLimits) error {
+	l = l.withDefaults()
+	timeout, err := l.validate()
+	if err != nil {
+		return err
+	}
+
+	lim.mu.Lock()
+	if lim.last.IsZero() || lim.tokens > float64(l.RateBurst) {
+		lim.tokens = float64(l.RateBurst)
+	}
+	lim.last = time.Now()
+	lim.limits, lim.timeout = l, timeout
+	lim.broadcast()
+	lim.mu.Unlock()
+
+	metrics.ClusterLimit.WithLabelValues(lim.label, "rate").Set(l.RateLimit)
+	metrics.ClusterLimit.WithLabelValues(lim.label, "burst").Set(float64(l.RateBurst))
+	metrics.ClusterLimit.WithLabelValues(lim.label, "concurrent").Set(float64(l.MaxConcurrent))
+	return nil
+}
+
+func (lim *limiter) status() ClusterLimitStatus {
+	lim.mu.Lock()
+	defer lim.mu.Unlock()
+	return ClusterLimitStatus{ClusterLimits: lim.limits, Inflight: lim.inflight, Queued: lim.queued}
+}
+
+// acquire waits until the limits let a request through, release must be
+// called once it is done
+func (lim *limiter) acquire(ctx context.Context) (release func(), err error) {
+	if lim == nil {
+		return func() {}, nil
+	}
+
+	var deadline <-chan time.Time
+	var timeout time.Duration
+	queued := false
+	defer func() {
+		if queued {
+			lim.mu.Lock()
+			lim.queued--
+			metrics.ClusterQueued.WithLabelValues(lim.label).Set(float64(lim.queued))
+			lim.mu.Unlock()
+		}
+	}()
+
+	for {
+		lim.mu.Lock()
+		wait, ok := lim.take(time.Now())
+		if ok {
+			lim.inflight++
+			metrics.ClusterInflight.WithLabelValues(lim.label).Set(float64(lim.inflight))
+			lim.mu.Unlock()
+			return lim.release, nil
+		}
+		if !queued {
+			queued, timeout = true, lim.timeout
+			lim.queued++
+			metrics.ClusterQueued.WithLabelValues(lim.label).Set(float64(lim.queued))
+			t := time.NewTimer(timeout)
+			defer t.Stop()
+			deadline = t.C
+		}
+		wake := lim.wake
+		lim.mu.Unlock()
+
+		// without a token to wait for, only a finished request or new
+		// limits can let this one through
+		var next <-chan time.Time
+		stop := func() bool { return false }
+		if wait > 0 {
+			t := time.NewTimer(wait)
+			next, stop = t.C, t.Stop
+		}
+		select {
+		case <-wake:
+		case <-next:
+		case <-deadline:
+			err = fmt.Errorf("%s, queued for %s", ErrRateLimited, timeout)
+			metrics.SearchRateLimited.WithLabelValues(lim.label).Inc()
+		case <-ctx.Done():
+			err = ctx.Err()
+		}
+		stop()
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+// take refills the bucket and takes a token and a slot if both are free,
+// otherwise it returns how long until the next token if that is what is
+// missing. Called with mu held
+func (lim *limiter) take(now time.Time) (time.Duration, bool) {
+	l := lim.limits
+	if l.RateLimit > 0 {
+		lim.tokens += now.Sub(lim.last).Seconds() * l.RateLimit
+		if lim.tokens > float64(l.RateBurst) {
+			lim.tokens = float64(l.RateBurst)
+		}
+	}
+	lim.last = now
+
+	if l.MaxConcurrent > 0 && lim.inflight >= l.MaxConcurrent {
+		return 0, false
+	}
+	if l.RateLimit > 0 {
+		if lim.tokens < 1 {
+			return time.Duration((1 - lim.tokens) / l.RateLimit * float64(time.Second)), false
+		}
+		lim.tokens--
+	}
+	return 0, true
+}
+
+func (lim *limiter) release() {
+	lim.mu.Lock()
+	lim.inflight--
+	metrics.ClusterInflight.WithLabelValues(lim.label).Set(float64(lim.inflight))
+	lim.broadcast()
+	lim.mu.Unlock()
+}
+
+// broadcast wakes every waiting request, called with mu held
+func (lim *limiter) broadcast() {
+	close(lim.wake)
+	lim.wake = make(chan struct{})
+}
+
+// ownedCluster returns the cluster named name which tenantName may change,
+// its own one or, for the default tenant, a global one
+func ownedCluster(tenantName, name string) (*cluster, error) {
+	if tenantName == "" {
+		tenantName = tenant.Default
+	}
+	clustersMu.RLock()
+	defer clustersMu.RUnlock()
+	if cl, ok := clusters[tenantName+"/"+name]; ok {
+		return cl, nil
+	}
+	if cl, ok := clusters[name]; ok {
+		if tenantName == tenant.Default {
+			return cl, nil
+		}
+		return nil, fmt.Errorf("cluster %q is shared by every tenant, only the %s tenant may change it", name, tenant.Default)
+	}
+	return nil, fmt.Errorf("unknown cluster: %q", name)
+}
+
+// ClusterLimitsOf returns the limits and their current use of every cluster
+// tenantName may search
+func ClusterLimitsOf(tenantName string) map[string]ClusterLimitStatus {
+	if tenantName == "" {
+		tenantName = tenant.Default
+	}
+	clustersMu.RLock()
+	defer clustersMu.RUnlock()
+	out := make(map[string]ClusterLimitStatus)
+	for key, cl := range clusters {
+		if key != cl.name && key != tenantName+"/"+cl.name {
+			continue
+		}
+		if _, own := clusters[tenantName+"/"+cl.name]; own && key == cl.name {
+			// shadowed by the tenant's own cluster
+			continue
+		}
+		out[cl.name] = cl.limiter.status()
+	}
+	return out
+}
+
+// SetClusterLimits changes the limits of a cluster of tenantName until the
+// next restart, which loads them from the config again
+func SetClusterLimits(tenantName, name string, l ClusterLimits) error {
+	cl, err := ownedCluster(tenantName, name)
+	if err != nil {
+		return err
+	}
+	return cl.limiter.set(l)
+}
@@ -4,13 +4,18 @@ import (
 	"bytes"
 	"crypto/sha1"
 	"encoding/hex"
+	"errors"
 	"fmt"
 	"os"
 	"reflect"
 	"strconv"
 	"strings"
+	"sync/atomic"
+	"time"
 
 	lua "github.com/Shopify/go-lua"
+
+	"github.com/CheerChen/esalert/metrics"
 )
 
 // LuaRunner performs some arbitrary lua code. The code can either be sourced from a
@@ -23,6 +28,11 @@ type LuaRunner struct {
 // Do performs the actual lua code, returning whatever the lua code returned, or
 // false if there was an error
 func (l *LuaRunner) Do(c Context) (interface{}, bool) {
+	start := time.Now()
+	defer func() {
+		metrics.LuaDuration.Observe(time.Since(start).Seconds())
+	}()
+
 	if l.File != "" {
 		return RunFile(c, l.File)
 	} else if l.Inline != "" {
@@ -31,6 +41,33 @@ func (l *LuaRunner) Do(c Context) (interface{}, bool) {
 	return nil, false
 }
 
+// pinging is 1 while a PingLua snippet waits for or runs on the vm
+var pinging int32
+
+// PingLua runs a trivial lua snippet and reports whether a lua vm picked it
+// up within the timeout. A snippet which timed out stays queued for the vm,
+// no other one is sent until it ran
+func PingLua(timeout time.Duration) error {
+	if !atomic.CompareAndSwapInt32(&pinging, 0, 1) {
+		return errors.New("previous lua ping still waiting for the vm")
+	}
+	done := make(chan bool, 1)
+	go func() {
+		defer atomic.StoreInt32(&pinging, 0)
+		ret, ok := RunInline(Context{}, "return true")
+		done <- ok && ret == true
+	}()
+	select {
+	case ok := <-done:
+		if !ok {
+			return errors.New("lua vm returned an unexpected result")
+		}
+		return nil
+	case <-time.After(timeout):
+		return fmt.Errorf("no lua vm available within %s", timeout)
+	}
+}
+
 type cmd struct {
 	ctx      Context
 	filename string
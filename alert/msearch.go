@@ -0,0 +1,213 @@
+package alert
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.uber.org/zap"
+
+	"github.com/CheerChen/esalert/logger"
+	"github.com/CheerChen/esalert/metrics"
+	"github.com/CheerChen/esalert/tracing"
+)
+
+// batcher groups the searches sent to a cluster within a short window, as
+// they happen when many alerts fire on the same tick, into a single _msearch
+// request
+type batcher struct {
+	cl     *cluster
+	window time.Duration
+	max    int
+
+	mu      sync.Mutex
+	pending []*batchItem
+	timer   *time.Timer // flushes pending once the window passed
+	gen     uint64      // of pending, bumped on every flush
+}
+
+type batchItem struct {
+	ctx   context.Context
+	index string
+	body  []byte
+	done  chan batchResult
+}
+
+type batchResult struct {
+	raw []byte
+	err error
+}
+
+// search queues a search of index and waits for its own response
+func (b *batcher) search(ctx context.Context, index string, body []byte) ([]byte, error) {
+	item := &batchItem{ctx: ctx, index: index, body: body, done: make(chan batchResult, 1)}
+
+	b.mu.Lock()
+	b.pending = append(b.pending, item)
+	switch {
+	case len(b.pending) >= b.max:
+		if b.timer != nil {
+			b.timer.Stop()
+		}
+		go b.flush(b.take())
+	case len(b.pending) == 1:
+		// a timer which already fired for an earlier batch sees another
+		// generation and leaves this one alone
+		gen := b.gen
+		b.timer = time.AfterFunc(b.window, func() {
+			b.mu.Lock()
+			if b.gen != gen {
+				b.mu.Unlock()
+				return
+			}
+			items := b.take()
+			b.mu.Unlock()
+			b.flush(items)
+		})
+	}
+	b.mu.Unlock()
+
+	select {
+	case r := <-item.done:
+		return r.raw, r.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// take empties pending and returns its items. It must be called with mu held
+func (b *batcher) take() []*batchItem {
+	items := b.pending
+	b.pending = nil
+	b.gen++
+	return items
+}
+
+func (b *batcher) flush(items []*batchItem) {
+	if len(items) == 0 {
+		return
+	}
+	metrics.MsearchBatchSize.WithLabelValues(b.cl.label()).Observe(float64(len(items)))
+	if len(items) == 1 {
+		// nothing to group, keep the trace of the alert
+		it := items[0]
+		raw, err := b.cl.searchRaw(it.ctx, it.index+"/_search", it.body)
+		it.done <- batchResult{raw, err}
+		return
+	}
+
+	for _, it := range items {
+		countRequest(it.ctx)
+	}
+	results, err := b.msearch(items)
+	if err != nil {
+		logger.Warn("msearch failed",
+			zap.String("cluster", b.cl.label()),
+			zap.Int("searches", len(items)),
+			zap.String("err", err.Error()),
+		)
+	}
+	for i, it := range items {
+		if err != nil {
+			it.done <- batchResult{err: err}
+			continue
+		}
+		it.done <- results[i]
+	}
+}
+
+// msearch sends items as one _msearch request and maps every response back
+// to its item, an item which failed gets its own *ElasticError
+func (b *batcher) msearch(items []*batchItem) ([]batchResult, error) {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	for _, it := range items {
+		if err := enc.Encode(map[string]string{"index": it.index}); err != nil {
+			return nil, err
+		}
+		buf.Write(bytes.TrimSpace(it.body))
+		buf.WriteByte('\n')
+	}
+
+	ctx, cancel := batchContext(items)
+	defer cancel()
+	ctx, span := tracing.StartLinked(ctx, "msearch", itemContexts(items),
+		attribute.String("cluster", b.cl.label()),
+		attribute.Int("searches", len(items)),
+	)
+	status, body, err := b.cl.request(ctx, "POST", "_msearch", buf.Bytes())
+	tracing.End(span, err)
+	if err != nil {
+		return nil, err
+	}
+	if status != 200 {
+		return nil, parseElasticError(status, body)
+	}
+	var resp struct {
+		Responses []json.RawMessage `json:"responses"`
+	}
+	if err := json.Unmarshal(body, &resp); err != nil {
+		return nil, err
+	}
+	if len(resp.Responses) != len(items) {
+		return nil, fmt.Errorf("msearch returned %d responses for %d searches", len(resp.Responses), len(items))
+	}
+
+	results := make([]batchResult, len(items))
+	for i, raw := range resp.Responses {
+		var head struct {
+			Status int             `json:"status"`
+			Error  json.RawMessage `json:"error"`
+		}
+		json.Unmarshal(raw, &head)
+		if len(head.Error) > 0 {
+			results[i].err = parseElasticError(head.Status, raw)
+			continue
+		}
+		results[i].raw = raw
+	}
+	return results, nil
+}
+
+// batchContext returns the context of the _msearch request of items. It has
+// the earliest deadline of the items and is canceled once every item gave up
+// waiting. It carries nothing else of the items, their searches are counted
+// by flush
+func batchContext(items []*batchItem) (context.Context, context.CancelFunc) {
+	var deadline time.Time
+	for _, it := range items {
+		if d, ok := it.ctx.Deadline(); ok && (deadline.IsZero() || d.Before(deadline)) {
+			deadline = d
+		}
+	}
+	var ctx context.Context
+	var cancel context.CancelFunc
+	if deadline.IsZero() {
+		ctx, cancel = context.WithCancel(context.Background())
+	} else {
+		ctx, cancel = context.WithDeadline(context.Background(), deadline)
+	}
+	go func() {
+		for _, it := range items {
+			select {
+			case <-it.ctx.Done():
+			case <-ctx.Done():
+				return
+			}
+		}
+		cancel()
+	}()
+	return ctx, cancel
+}
+
+func itemContexts(items []*batchItem) []context.Context {
+	ctxs := make([]context.Context, len(items))
+	for i, it := range items {
+		ctxs[i] = it.ctx
+	}
+	return ctxs
+}
@@ -0,0 +1,245 @@
+package alert
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/CheerChen/esalert/logger"
+)
+
+const (
+	PagePIT         = "pit"          // search_after on a point in time, elasticsearch 7.12+
+	PageSearchAfter = "search_after" // search_after without a point in time
+	PageScroll      = "scroll"       // scroll api, for older clusters
+)
+
+// Paginate makes an alert collect every matching hit, page by page, instead
+// of the first "size" only. Each page has the size of the search
+type Paginate struct {
+	Mode      string `yaml:"mode" mapstructure:"mode"`             // pit (the default), search_after or scroll
+	MaxDocs   int    `yaml:"max_docs" mapstructure:"max_docs"`     // hits collected at most, default 10000
+	KeepAlive string `yaml:"keep_alive" mapstructure:"keep_alive"` // of the point in time or scroll, default "1m"
+}
+
+const maxDocsLimit = 100000
+
+func (p *Paginate) init() error {
+	switch p.Mode {
+	case "":
+		p.Mode = PagePIT
+	case PagePIT, PageSearchAfter, PageScroll:
+	default:
+		return fmt.Errorf("paginate mode must be %q, %q or %q", PagePIT, PageSearchAfter, PageScroll)
+	}
+	if p.MaxDocs == 0 {
+		p.MaxDocs = 10000
+	}
+	if p.MaxDocs < 0 || p.MaxDocs > maxDocsLimit {
+		return fmt.Errorf("paginate max_docs must be between 1 and %d", maxDocsLimit)
+	}
+	if p.KeepAlive == "" {
+		p.KeepAlive = "1m"
+	}
+	if _, err := time.ParseDuration(p.KeepAlive); err != nil {
+		return fmt.Errorf("paginate keep_alive: %s", err)
+	}
+	return nil
+}
+
+// paginate runs the search of an alert page by page until every hit or
+// MaxDocs hits are collected. Total, shards and aggregations are those of
+// the first page
+func (p Paginate) paginate(ctx context.Context, cl *cluster, path string, query Dict) (Result, error) {
+	if size, ok := query["size"]; ok && fmt.Sprint(size) == "0" {
+		return search(ctx, cl, path, query)
+	}
+
+	switch p.Mode {
+	case PageScroll:
+		return p.scroll(ctx, cl, path, query)
+	case PagePIT:
+		return p.pit(ctx, cl, path, query)
+	default:
+		return p.searchAfter(ctx, cl, path, query, "")
+	}
+}
+
+func (p Paginate) scroll(ctx context.Context, cl *cluster, path string, query Dict) (Result, error) {
+	res, err := search(ctx, cl, withParam(path, "scroll", p.KeepAlive), query)
+	if err != nil {
+		return res, err
+	}
+	scrollPath := cl.rootPath(path, "_search/scroll")
+	defer func() {
+		if res.ScrollId == "" {
+			return
+		}
+		body := map[string]interface{}{"scroll_id": []string{res.ScrollId}}
+		if err := cl.do(context.Background(), "DELETE", scrollPath, body, nil); err != nil {
+			logger.Warn("failed to clear scroll", zap.String("err", err.Error()))
+		}
+	}()
+
+	page := res.Hits
+	for len(page) > 0 && !p.collect(&res, nil) {
+		var next Result
+		body := map[string]interface{}{"scroll": p.KeepAlive, "scroll_id": res.ScrollId}
+		if err := cl.do(ctx, "POST", scrollPath, body, &next); err != nil {
+			return res, err
+		}
+		res.ScrollId = next.ScrollId
+		mergeShards(&res, next)
+		page = next.Hits
+		p.collect(&res, page)
+	}
+	return res, nil
+}
+
+func (p Paginate) pit(ctx context.Context, cl *cluster, path string, query Dict) (Result, error) {
+	index := indexOf(cl, path)
+	var opened struct {
+		Id string `json:"id"`
+	}
+	if err := cl.do(ctx, "POST", withParam(cl.rootPath(path, index+"/_pit"), "keep_alive", p.KeepAlive), nil, &opened); err != nil {
+		return Result{}, fmt.Errorf("opening point in time: %s", err)
+	}
+
+	// the index comes with the point in time, which is not allowed in the path
+	res, err := p.searchAfter(ctx, cl, cl.rootPath(path, "_search"), query, opened.Id)
+
+	// the id may change between pages, the latest one is closed
+	id := opened.Id
+	if res.PitId != "" {
+		id = res.PitId
+	}
+	body := map[string]interface{}{"id": id}
+	if err := cl.do(context.Background(), "DELETE", cl.rootPath(path, "_pit"), body, nil); err != nil {
+		logger.Warn("failed to close point in time", zap.String("err", err.Error()))
+	}
+	return res, err
+}
+
+func (p Paginate) searchAfter(ctx context.Context, cl *cluster, path string, query Dict, pitId string) (Result, error) {
+	body := copyDict(query)
+	if _, ok := body["sort"]; !ok {
+		if pitId != "" {
+			// _shard_doc came with 7.12, pit needs at least that version
+			body["sort"] = []interface{}{Dict{"_shard_doc": "asc"}}
+		} else {
+			body["sort"] = []interface{}{Dict{"_doc": "asc"}}
+		}
+	}
+	if pitId != "" {
+		body["pit"] = Dict{"id": pitId, "keep_alive": p.KeepAlive}
+	}
+
+	res, err := search(ctx, cl, path, body)
+	if err != nil {
+		return res, err
+	}
+
+	// later pages only need the hits
+	delete(body, "aggs")
+	delete(body, "aggregations")
+	body["track_total_hits"] = false
+
+	page := res.Hits
+	for len(page) > 0 && !p.collect(&res, nil) {
+		last := page[len(page)-1]
+		if len(last.Sort) == 0 {
+			return res, errors.New("search_after: hits carry no sort values")
+		}
+		body["search_after"] = last.Sort
+		if res.PitId != "" {
+			body["pit"] = Dict{"id": res.PitId, "keep_alive": p.KeepAlive}
+		}
+
+		next, err := search(ctx, cl, path, body)
+		if err != nil {
+			return res, err
+		}
+		if next.PitId != "" {
+			res.PitId = next.PitId
+		}
+		mergeShards(&res, next)
+		page = next.Hits
+		p.collect(&res, page)
+	}
+	return res, nil
+}
+
+// collect appends page to the hits of res, and tells whether MaxDocs is
+// reached. The hits are truncated unless the total tells exactly MaxDocs
+// documents match, a lower bound ("gte") or untracked total (track_total_hits
+// false) can't rule out more pages
+func (p Paginate) collect(res *Result, page []Hit) bool {
+	if page != nil {
+		res.Hits = append(res.Hits, page...)
+	}
+	if len(res.Hits) >= p.MaxDocs {
+		if len(res.Hits) > p.MaxDocs || res.HitCountRelation != "eq" || uint64(len(res.Hits)) < res.HitCount {
+			res.HitsTruncated = true
+		}
+		res.Hits = res.Hits[:p.MaxDocs]
+		return true
+	}
+	return false
+}
+
+// mergeShards keeps the shard failures of a later page
+func mergeShards(res *Result, page Result) {
+	if page.Shards.Failed > res.Shards.Failed {
+		res.Shards = page.Shards
+	}
+}
+
+func copyDict(d Dict) Dict {
+	c := make(Dict, len(d))
+	for k, v := range d {
+		c[k] = v
+	}
+	return c
+}
+
+func withParam(path, key, value string) string {
+	sep := "?"
+	if strings.Contains(path, "?") {
+		sep = "&"
+	}
+	return path + sep + key + "=" + url.QueryEscape(value)
+}
+
+// rootPath returns p on the root of the cluster. search is the search path,
+// which ad hoc clusters need to find the node
+func (cl *cluster) rootPath(search, p string) string {
+	if len(cl.conf.URLs) > 0 {
+		return p
+	}
+	u, err := url.Parse(search)
+	if err != nil {
+		return p
+	}
+	return u.Scheme + "://" + u.Host + "/" + p
+}
+
+// indexOf returns the index pattern of a search path such as
+// "logstash-*/_search" or "http://host:9200/logstash-*/_search"
+func indexOf(cl *cluster, search string) string {
+	p := search
+	if len(cl.conf.URLs) == 0 {
+		if u, err := url.Parse(search); err == nil {
+			p = u.Path
+		}
+	}
+	if i := strings.Index(p, "?"); i >= 0 {
+		p = p[:i]
+	}
+	p = strings.Trim(p, "/")
+	return strings.TrimSuffix(strings.TrimSuffix(p, "_search"), "/")
+}
@@ -0,0 +1,597 @@
+package alert
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/CheerChen/esalert/logger"
+	"github.com/CheerChen/esalert/tenant"
+)
+
+// PolicyConf limits the cost of the searches of jobs, checked when a job is
+// saved or tested, see [Policy]. The zero value of a rule disables it
+type PolicyConf struct {
+	MaxSize            int      // largest "size" of a search
+	BanLeadingWildcard bool     // reject terms starting with a wildcard, e.g. "*error"
+	RequireTimeRange   bool     // every search needs a range on TimeField
+	MaxTimeRange       string   // widest range on TimeField, e.g. "7d"
+	TimeField          string   `default:"@timestamp"`
+	MaxBuckets         int      // buckets the aggregations may create, estimated from their sizes
+	BannedIndices      []string // index patterns no search may use, e.g. "*" or "_all"
+	Validate           bool     // also check the query with _validate/query?explain
+}
+
+// Violation is a policy rule broken by a search of an alert
+type Violation struct {
+	Search string `json:"search"` // "input" or "searches.<name>"
+	Rule   string `json:"rule"`
+	Reason string `json:"reason"`
+}
+
+func (v Violation) String() string {
+	return fmt.Sprintf("%s: %s: %s", v.Search, v.Rule, v.Reason)
+}
+
+// policyTarget is implemented by the inputs searching an index, which are
+// the ones checked against the policy. policySearch returns the index and
+// the query dsl the rendered body amounts to
+type policyTarget interface {
+	Renderer
+	policySearch(ctx context.Context, p PolicyConf, body map[string]interface{}) (string, map[string]interface{}, error)
+	validatePath(ctx context.Context) (*cluster, string, error)
+}
+
+// CheckPolicy renders the searches of the alert as they would be sent at now
+// and checks them against the policy. An error is only returned when a
+// search cannot be rendered
+func (a Alert) CheckPolicy(ctx context.Context, now time.Time) ([]Violation, error) {
+	p := conf.Policy
+	ctx = tenant.NewContext(ctx, a.Tenant)
+	c := queryContext(a.Name, now)
+
+	inputs := map[string]Inputer{}
+	if a.Source.Inputer != nil {
+		inputs["input"] = a.Source.Inputer
+	}
+	for name, in := range a.Named {
+		inputs["searches."+name] = in.Inputer
+	}
+
+	var violations []Violation
+	for name, in := range inputs {
+		t, ok := in.(policyTarget)
+		if !ok {
+			continue
+		}
+		q, err := t.Render(c)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", name, err)
+		}
+		body, _ := toStringMap(q)
+		index, body, err := t.policySearch(ctx, p, body)
+		if err != nil {
+			// a search the policy cannot look into is not let through
+			violations = append(violations, Violation{Search: name, Rule: "unchecked", Reason: err.Error()})
+			continue
+		}
+		for _, v := range p.check(index, body) {
+			v.Search = name
+			violations = append(violations, v)
+		}
+		if p.Validate {
+			if v, ok := validateQuery(ctx, t, body); !ok {
+				v.Search = name
+				violations = append(violations, v)
+			}
+		}
+	}
+	return violations, nil
+}
+
+// checksBody tells whether a rule of p looks into the query of a search
+func (p PolicyConf) checksBody() bool {
+	return p.MaxSize > 0 || p.BanLeadingWildcard || p.RequireTimeRange || p.MaxTimeRange != "" || p.MaxBuckets > 0
+}
+
+// check applies the rules of p to a search of index with body, which may be
+// nil for inputs without a body
+func (p PolicyConf) check(index string, body map[string]interface{}) []Violation {
+	var out []Violation
+	add := func(rule, format string, args ...interface{}) {
+		out = append(out, Violation{Rule: rule, Reason: fmt.Sprintf(format, args...)})
+	}
+
+	if index == "" {
+		index = "_all"
+	}
+	for _, idx := range strings.Split(index, ",") {
+		for _, banned := range p.BannedIndices {
+			if strings.TrimSpace(idx) == banned {
+				add("index", "index pattern %q may not be searched", banned)
+			}
+		}
+	}
+
+	if p.MaxSize > 0 {
+		if size, ok := toNumber(body["size"]); ok && size > float64(p.MaxSize) {
+			add("size", "size %v is above %d", body["size"], p.MaxSize)
+		}
+	}
+
+	if p.BanLeadingWildcard {
+		walk(body["query"], func(key string, v interface{}) {
+			if term, ok := leadingWildcard(key, v); ok {
+				add("leading_wildcard", "%s query %q starts with a wildcard", key, term)
+			}
+		})
+	}
+
+	timeField := p.TimeField
+	if timeField == "" {
+		timeField = "@timestamp"
+	}
+	var spans []time.Duration
+	walk(body["query"], func(key string, v interface{}) {
+		if key != "range" {
+			return
+		}
+		r, err := toStringMap(v)
+		if err != nil {
+			return
+		}
+		if bounds, ok := r[timeField]; ok {
+			spans = append(spans, rangeSpan(bounds))
+		}
+	})
+	if p.RequireTimeRange && len(spans) == 0 {
+		add("time_range", "no range filter on %s", timeField)
+	}
+
+	var span time.Duration = -1
+	if len(spans) > 0 {
+		// the narrowest range limits what the search reads
+		span = spans[0]
+		for _, s := range spans[1:] {
+			if s >= 0 && (span < 0 || s < span) {
+				span = s
+			}
+		}
+	}
+	if max, ok := parseDateMath(p.MaxTimeRange); ok {
+		if len(spans) == 0 {
+			if !p.RequireTimeRange {
+				add("max_time_range", "no range filter on %s, the search reads every document", timeField)
+			}
+		} else if span < 0 {
+			add("max_time_range", "could not tell how wide the range on %s is, it must start no earlier than now-%s", timeField, p.MaxTimeRange)
+		} else if span > max {
+			add("max_time_range", "range on %s spans %s, more than %s", timeField, span, p.MaxTimeRange)
+		}
+	}
+
+	if p.MaxBuckets > 0 {
+		aggs := body["aggs"]
+		if aggs == nil {
+			aggs = body["aggregations"]
+		}
+		if n := estimateBuckets(aggs, span); n > p.MaxBuckets {
+			add("buckets", "aggregations may create %d buckets, more than %d", n, p.MaxBuckets)
+		}
+	}
+	return out
+}
+
+// walk calls fn for every key and value of the maps nested in v
+func walk(v interface{}, fn func(key string, v interface{})) {
+	switch vv := v.(type) {
+	case []interface{}:
+		for _, item := range vv {
+			walk(item, fn)
+		}
+	default:
+		m, err := toStringMap(v)
+		if err != nil {
+			return
+		}
+		for key, item := range m {
+			fn(key, item)
+			walk(item, fn)
+		}
+	}
+}
+
+// leadingTerm matches a term of a query string starting with a wildcard,
+// a lone "*" matches every document and is allowed
+var leadingTerm = regexp.MustCompile(`(?:^|[\s(:\[])[*?]+[^\s*?):\]]`)
+
+// leadingWildcard tells whether the query clause key: v starts a term with
+// a wildcard, and returns that term
+func leadingWildcard(key string, v interface{}) (string, bool) {
+	switch key {
+	case "query_string", "simple_query_string":
+		m, err := toStringMap(v)
+		if err != nil {
+			return "", false
+		}
+		q, _ := m["query"].(string)
+		return q, leadingTerm.MatchString(q)
+	case "wildcard", "regexp":
+		m, err := toStringMap(v)
+		if err != nil {
+			return "", false
+		}
+		for _, f := range m {
+			term, ok := f.(string)
+			if !ok {
+				fm, _ := toStringMap(f)
+				if term, ok = fm["value"].(string); !ok {
+					term, _ = fm["wildcard"].(string)
+				}
+			}
+			if (key == "wildcard" && strings.TrimLeft(term, "*?") != term) ||
+				(key == "regexp" && strings.HasPrefix(term, ".*")) {
+				return term, true
+			}
+		}
+	}
+	return "", false
+}
+
+// rangeSpan returns how wide the range query bounds is, -1 when it has no
+// lower bound or a bound cannot be read
+func rangeSpan(bounds interface{}) time.Duration {
+	m, err := toStringMap(bounds)
+	if err != nil {
+		return -1
+	}
+	format, _ := m["format"].(string)
+	now := time.Now()
+	lower, ok := m["gte"]
+	if !ok {
+		lower, ok = m["gt"]
+	}
+	if !ok {
+		return -1
+	}
+	from, ok := parseBound(lower, format, now)
+	if !ok {
+		return -1
+	}
+	to := now
+	if upper, ok := m["lte"]; ok {
+		to, ok = parseBound(upper, format, now)
+		if !ok {
+			return -1
+		}
+	} else if upper, ok := m["lt"]; ok {
+		to, ok = parseBound(upper, format, now)
+		if !ok {
+			return -1
+		}
+	}
+	return to.Sub(from)
+}
+
+// parseBound reads a bound of a range query: date math relative to now, a
+// date or an epoch in milliseconds, or seconds with format epoch_second
+func parseBound(v interface{}, format string, now time.Time) (time.Time, bool) {
+	if n, ok := toNumber(v); ok {
+		if strings.Contains(format, "epoch_second") {
+			return time.Unix(int64(n), 0), true
+		}
+		return time.Unix(0, int64(n)*int64(time.Millisecond)), true
+	}
+	s, ok := v.(string)
+	if !ok {
+		return time.Time{}, false
+	}
+	if strings.HasPrefix(s, "now") {
+		t := now
+		expr := s[len("now"):]
+		if i := strings.Index(expr, "/"); i >= 0 {
+			// rounding moves the bound by less than one unit
+			expr = expr[:i]
+		}
+		for expr != "" {
+			sign := expr[0]
+			if sign != '+' && sign != '-' {
+				return time.Time{}, false
+			}
+			end := 1
+			for end < len(expr) && expr[end] != '+' && expr[end] != '-' {
+				end++
+			}
+			d, ok := parseDateMath(expr[1:end])
+			if !ok {
+				return time.Time{}, false
+			}
+			if sign == '-' {
+				d = -d
+			}
+			t = t.Add(d)
+			expr = expr[end:]
+		}
+		return t, true
+	}
+	for _, layout := range []string{time.RFC3339Nano, "2006-01-02T15:04:05", "2006-01-02 15:04:05", "2006-01-02"} {
+		if t, err := time.Parse(layout, s); err == nil {
+			return t, true
+		}
+	}
+	return time.Time{}, false
+}
+
+var dateMathUnits = map[string]time.Duration{
+	"s": time.Second,
+	"m": time.Minute,
+	"h": time.Hour,
+	"H": time.Hour,
+	"d": 24 * time.Hour,
+	"w": 7 * 24 * time.Hour,
+	"M": 30 * 24 * time.Hour,
+	"y": 365 * 24 * time.Hour,
+}
+
+// parseDateMath reads a duration in elasticsearch date math units, e.g. "15m"
+// or "7d", months and years are taken as 30 and 365 days
+func parseDateMath(s string) (time.Duration, bool) {
+	if s == "" {
+		return 0, false
+	}
+	unit, ok := dateMathUnits[s[len(s)-1:]]
+	if !ok {
+		return 0, false
+	}
+	n := 1
+	if s[:len(s)-1] != "" {
+		var err error
+		if n, err = strconv.Atoi(s[:len(s)-1]); err != nil {
+			return 0, false
+		}
+	}
+	return time.Duration(n) * unit, true
+}
+
+var calendarIntervals = map[string]string{
+	"minute":  "1m",
+	"hour":    "1h",
+	"day":     "1d",
+	"week":    "1w",
+	"month":   "1M",
+	"quarter": "3M",
+	"year":    "1y",
+}
+
+// estimateBuckets sums the buckets the aggregations aggs may create, sub
+// aggregations multiply the buckets of their parent. span is the time range
+// of the search, -1 if unknown, used for date histograms
+func estimateBuckets(aggs interface{}, span time.Duration) int {
+	m, err := toStringMap(aggs)
+	if err != nil {
+		return 0
+	}
+	total := 0
+	for _, v := range m {
+		agg, err := toStringMap(v)
+		if err != nil {
+			continue
+		}
+		n := 0
+		for typ, body := range agg {
+			switch typ {
+			case "aggs", "aggregations", "meta":
+			default:
+				n = bucketsOf(typ, body, span)
+			}
+		}
+		sub := agg["aggs"]
+		if sub == nil {
+			sub = agg["aggregations"]
+		}
+		if s := estimateBuckets(sub, span); s > 0 {
+			if n == 0 {
+				n = 1
+			}
+			n *= s
+		}
+		total += n
+	}
+	return total
+}
+
+// bucketsOf returns the buckets a single aggregation may create, 0 for
+// metric aggregations
+func bucketsOf(typ string, body interface{}, span time.Duration) int {
+	m, _ := toStringMap(body)
+	switch typ {
+	case "terms", "significant_terms", "rare_terms", "multi_terms", "composite":
+		if size, ok := toNumber(m["size"]); ok {
+			return int(size)
+		}
+		return 10
+	case "filters":
+		switch f := m["filters"].(type) {
+		case []interface{}:
+			return len(f)
+		default:
+			fm, _ := toStringMap(f)
+			return len(fm)
+		}
+	case "date_histogram":
+		interval, _ := m["fixed_interval"].(string)
+		if interval == "" {
+			interval, _ = m["calendar_interval"].(string)
+		}
+		if interval == "" {
+			interval, _ = m["interval"].(string)
+		}
+		if c, ok := calendarIntervals[interval]; ok {
+			interval = c
+		}
+		d, ok := parseDateMath(interval)
+		if !ok || span < 0 || d <= 0 {
+			return 1
+		}
+		return int(math.Ceil(float64(span) / float64(d)))
+	case "filter", "global", "missing", "nested", "reverse_nested", "sampler", "histogram", "range", "date_range", "auto_date_histogram":
+		return 1
+	}
+	return 0
+}
+
+func toNumber(v interface{}) (float64, bool) {
+	switch n := v.(type) {
+	case int:
+		return float64(n), true
+	case int64:
+		return float64(n), true
+	case uint64:
+		return float64(n), true
+	case float64:
+		return n, true
+	case string:
+		f, err := strconv.ParseFloat(n, 64)
+		return f, err == nil
+	}
+	return 0, false
+}
+
+// validateQuery asks elasticsearch whether the query of body is valid. A
+// cluster which cannot be asked doesn't block saving the job
+func validateQuery(ctx context.Context, t policyTarget, body map[string]interface{}) (Violation, bool) {
+	query, ok := body["query"]
+	if !ok {
+		return Violation{}, true
+	}
+	cl, path, err := t.validatePath(ctx)
+	if err != nil {
+		return Violation{}, true
+	}
+	var resp struct {
+		Valid        bool   `json:"valid"`
+		Error        string `json:"error"`
+		Explanations []struct {
+			Index string `json:"index"`
+			Valid bool   `json:"valid"`
+			Error string `json:"error"`
+		} `json:"explanations"`
+	}
+	in := Dict{"query": query}
+	if err := cl.do(ctx, "POST", withParam(path, "explain", "true"), in, &resp); err != nil {
+		logger.Warn("could not validate query",
+			zap.String("cluster", cl.label()),
+			zap.String("err", err.Error()),
+		)
+		return Violation{}, true
+	}
+	if resp.Valid {
+		return Violation{}, true
+	}
+	reason := resp.Error
+	for _, e := range resp.Explanations {
+		if !e.Valid && e.Error != "" {
+			reason = e.Error
+			break
+		}
+	}
+	return Violation{Rule: "invalid_query", Reason: reason}, false
+}
+
+func (s *SearchInput) policySearch(ctx context.Context, p PolicyConf, body map[string]interface{}) (string, map[string]interface{}, error) {
+	if s.searchURL == "" {
+		return s.Index, body, nil
+	}
+	u, err := url.Parse(s.searchURL)
+	if err != nil {
+		return "", body, nil
+	}
+	return strings.Trim(strings.TrimSuffix(u.Path, "_search"), "/"), body, nil
+}
+
+func (s *SearchInput) validatePath(ctx context.Context) (*cluster, string, error) {
+	if s.searchURL == "" {
+		return s.resolve(ctx, s.Index+"/_validate/query")
+	}
+	u, err := url.Parse(s.searchURL)
+	if err != nil {
+		return nil, "", err
+	}
+	u.Path = strings.TrimSuffix(u.Path, "_search") + "_validate/query"
+	u.RawQuery = ""
+	return adhocCluster(ctx), u.String(), nil
+}
+
+func (s *CountInput) policySearch(ctx context.Context, p PolicyConf, body map[string]interface{}) (string, map[string]interface{}, error) {
+	return s.Index, body, nil
+}
+
+func (s *CountInput) validatePath(ctx context.Context) (*cluster, string, error) {
+	return s.resolve(ctx, s.Index+"/_validate/query")
+}
+
+// sqlFrom matches the tables of an elasticsearch sql statement
+var sqlFrom = regexp.MustCompile(`(?i)\bFROM\s+("[^"]+"|[^\s,;()]+)`)
+
+// policySearch of an sql query reads the indices from the statement, and has
+// elasticsearch translate it into query dsl when a rule needs to look into it
+// or the query is validated
+func (s *SQLQueryInput) policySearch(ctx context.Context, p PolicyConf, body map[string]interface{}) (string, map[string]interface{}, error) {
+	query, _ := body["query"].(string)
+	var indices []string
+	for _, m := range sqlFrom.FindAllStringSubmatch(query, -1) {
+		indices = append(indices, strings.Trim(m[1], `"`))
+	}
+	if !p.checksBody() && !p.Validate {
+		return strings.Join(indices, ","), nil, nil
+	}
+
+	cl, path, err := s.resolve(ctx, "_sql/translate")
+	if err != nil {
+		return "", nil, err
+	}
+	in := Dict{"query": query}
+	if tz, ok := body["time_zone"]; ok {
+		in["time_zone"] = tz
+	}
+	var search map[string]interface{}
+	if err := cl.do(ctx, "POST", path, in, &search); err != nil {
+		if _, answered := err.(*ElasticError); !answered && !p.checksBody() {
+			// like _validate/query, an unreachable cluster doesn't block saving
+			return strings.Join(indices, ","), nil, nil
+		}
+		return "", nil, fmt.Errorf("could not translate the sql query: %s", err)
+	}
+	return strings.Join(indices, ","), search, nil
+}
+
+// validatePath of an sql query fails, the statement is validated by
+// translating it
+func (s *SQLQueryInput) validatePath(ctx context.Context) (*cluster, string, error) {
+	return nil, "", errors.New("sql queries are validated by _sql/translate")
+}
+
+// policySearch of an eql search checks its filter and size, the eql
+// statement itself isn't query dsl
+func (s *EQLInput) policySearch(ctx context.Context, p PolicyConf, body map[string]interface{}) (string, map[string]interface{}, error) {
+	search := map[string]interface{}{}
+	if filter, ok := body["filter"]; ok {
+		search["query"] = filter
+	}
+	if size, ok := body["size"]; ok {
+		search["size"] = size
+	}
+	return s.Index, search, nil
+}
+
+func (s *EQLInput) validatePath(ctx context.Context) (*cluster, string, error) {
+	return s.resolve(ctx, s.Index+"/_validate/query")
+}
@@ -0,0 +1,267 @@
+package alert
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+)
+
+func TestPolicyCheck(t *testing.T) {
+	strict := PolicyConf{
+		MaxSize:            100,
+		BanLeadingWildcard: true,
+		RequireTimeRange:   true,
+		MaxTimeRange:       "7d",
+		MaxBuckets:         500,
+		BannedIndices:      []string{"*", "_all"},
+	}
+	tests := []struct {
+		name   string
+		policy PolicyConf
+		index  string
+		body   string
+		rules  []string
+	}{
+		{
+			name:   "accepted",
+			policy: strict,
+			index:  "nginx-*",
+			body:   `{"size":10,"query":{"bool":{"filter":[{"range":{"@timestamp":{"gte":"now-1d"}}},{"query_string":{"query":"status:500 AND host:web*"}}]}},"aggs":{"hosts":{"terms":{"field":"host","size":50}}}}`,
+		},
+		{
+			name:   "no rules configured",
+			policy: PolicyConf{},
+			index:  "*",
+			body:   `{"size":100000,"query":{"wildcard":{"msg":"*error"}}}`,
+		},
+		{
+			name:   "size above the limit",
+			policy: PolicyConf{MaxSize: 100},
+			index:  "logs",
+			body:   `{"size":101}`,
+			rules:  []string{"size"},
+		},
+		{
+			name:   "size at the limit",
+			policy: PolicyConf{MaxSize: 100},
+			index:  "logs",
+			body:   `{"size":"100"}`,
+		},
+		{
+			name:   "leading wildcard in a query string",
+			policy: PolicyConf{BanLeadingWildcard: true},
+			index:  "logs",
+			body:   `{"query":{"query_string":{"query":"msg:*timeout"}}}`,
+			rules:  []string{"leading_wildcard"},
+		},
+		{
+			name:   "lone wildcard in a query string",
+			policy: PolicyConf{BanLeadingWildcard: true},
+			index:  "logs",
+			body:   `{"query":{"query_string":{"query":"*"}}}`,
+		},
+		{
+			name:   "leading wildcard and regexp terms",
+			policy: PolicyConf{BanLeadingWildcard: true},
+			index:  "logs",
+			body:   `{"query":{"bool":{"should":[{"wildcard":{"msg":{"value":"?rror"}}},{"regexp":{"msg":".*fail"}}]}}}`,
+			rules:  []string{"leading_wildcard", "leading_wildcard"},
+		},
+		{
+			name:   "trailing wildcard term",
+			policy: PolicyConf{BanLeadingWildcard: true},
+			index:  "logs",
+			body:   `{"query":{"wildcard":{"msg":"err*"}}}`,
+		},
+		{
+			name:   "time range missing",
+			policy: PolicyConf{RequireTimeRange: true},
+			index:  "logs",
+			body:   `{"query":{"range":{"bytes":{"gte":10}}}}`,
+			rules:  []string{"time_range"},
+		},
+		{
+			name:   "time range on a custom field",
+			policy: PolicyConf{RequireTimeRange: true, TimeField: "ts"},
+			index:  "logs",
+			body:   `{"query":{"range":{"ts":{"gte":"now-5m"}}}}`,
+		},
+		{
+			name:   "time range too wide",
+			policy: PolicyConf{MaxTimeRange: "7d"},
+			index:  "logs",
+			body:   `{"query":{"range":{"@timestamp":{"gte":"now-30d","lt":"now"}}}}`,
+			rules:  []string{"max_time_range"},
+		},
+		{
+			name:   "time range in epoch milliseconds",
+			policy: PolicyConf{MaxTimeRange: "1h"},
+			index:  "logs",
+			body:   `{"query":{"range":{"@timestamp":{"gte":1700000000000,"lte":1700001800000}}}}`,
+		},
+		{
+			name:   "time range without a lower bound",
+			policy: PolicyConf{MaxTimeRange: "7d"},
+			index:  "logs",
+			body:   `{"query":{"range":{"@timestamp":{"lte":"now"}}}}`,
+			rules:  []string{"max_time_range"},
+		},
+		{
+			name:   "no time range with a maximum",
+			policy: PolicyConf{MaxTimeRange: "7d"},
+			index:  "logs",
+			body:   `{"query":{"match_all":{}}}`,
+			rules:  []string{"max_time_range"},
+		},
+		{
+			name:   "nested terms over the bucket limit",
+			policy: PolicyConf{MaxBuckets: 500},
+			index:  "logs",
+			body:   `{"aggs":{"hosts":{"terms":{"field":"host","size":100},"aggs":{"paths":{"terms":{"field":"path"}}}}}}`,
+			rules:  []string{"buckets"},
+		},
+		{
+			name:   "date histogram over the bucket limit",
+			policy: PolicyConf{MaxBuckets: 500},
+			index:  "logs",
+			body:   `{"query":{"range":{"@timestamp":{"gte":"now-1d"}}},"aggs":{"t":{"date_histogram":{"field":"@timestamp","fixed_interval":"1m"}}}}`,
+			rules:  []string{"buckets"},
+		},
+		{
+			name:   "date histogram within the bucket limit",
+			policy: PolicyConf{MaxBuckets: 500},
+			index:  "logs",
+			body:   `{"query":{"range":{"@timestamp":{"gte":"now-1d"}}},"aggs":{"t":{"date_histogram":{"field":"@timestamp","calendar_interval":"hour"},"aggs":{"avg":{"avg":{"field":"latency"}}}}}}`,
+		},
+		{
+			name:   "banned index",
+			policy: PolicyConf{BannedIndices: []string{"_all"}},
+			index:  "logs, _all",
+			rules:  []string{"index"},
+		},
+		{
+			name:   "no index is every index",
+			policy: PolicyConf{BannedIndices: []string{"_all"}},
+			rules:  []string{"index"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var body map[string]interface{}
+			if tt.body != "" {
+				if err := json.Unmarshal([]byte(tt.body), &body); err != nil {
+					t.Fatal(err)
+				}
+			}
+			var rules []string
+			for _, v := range tt.policy.check(tt.index, body) {
+				rules = append(rules, v.Rule)
+			}
+			sort.Strings(rules)
+			if !reflect.DeepEqual(rules, tt.rules) {
+				t.Errorf("violations %v, want %v", rules, tt.rules)
+			}
+		})
+	}
+}
+
+func TestCheckPolicyInputs(t *testing.T) {
+	// answers _sql/translate like elasticsearch, unknown queries don't parse
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/_sql/translate" {
+			t.Errorf("unexpected request to %s", r.URL.Path)
+		}
+		var in struct {
+			Query string `json:"query"`
+		}
+		json.NewDecoder(r.Body).Decode(&in)
+		switch in.Query {
+		case `SELECT host FROM "nginx-*" WHERE "@timestamp" > NOW() - INTERVAL 1 HOUR LIMIT 10`,
+			`SELECT host FROM _all WHERE "@timestamp" > NOW() - INTERVAL 1 HOUR LIMIT 10`:
+			w.Write([]byte(`{"size":10,"query":{"range":{"@timestamp":{"gt":"now-1h"}}}}`))
+		case `SELECT host FROM "nginx-*" LIMIT 5000`:
+			w.Write([]byte(`{"size":5000}`))
+		default:
+			w.WriteHeader(400)
+			w.Write([]byte(`{"error":{"type":"parsing_exception","reason":"line 1:8: mismatched input"},"status":400}`))
+		}
+	}))
+	defer srv.Close()
+
+	prev := conf.Policy
+	conf.Policy = PolicyConf{
+		MaxSize:          100,
+		RequireTimeRange: true,
+		MaxTimeRange:     "7d",
+		BannedIndices:    []string{"_all"},
+	}
+	defer func() { conf.Policy = prev }()
+
+	target := esTarget{URL: srv.URL}
+	tests := []struct {
+		name  string
+		input Inputer
+		rules []string
+	}{
+		{
+			name:  "sql accepted",
+			input: &SQLQueryInput{esTarget: target, Query: `SELECT host FROM "nginx-*" WHERE "@timestamp" > NOW() - INTERVAL 1 HOUR LIMIT 10`},
+		},
+		{
+			name:  "sql translated to a large search without a time range",
+			input: &SQLQueryInput{esTarget: target, Query: `SELECT host FROM "nginx-*" LIMIT 5000`},
+			rules: []string{"size", "time_range"},
+		},
+		{
+			name:  "sql on a banned index",
+			input: &SQLQueryInput{esTarget: target, Query: `SELECT host FROM _all WHERE "@timestamp" > NOW() - INTERVAL 1 HOUR LIMIT 10`},
+			rules: []string{"index"},
+		},
+		{
+			name:  "sql which doesn't translate",
+			input: &SQLQueryInput{esTarget: target, Query: `SELEC host FROM logs`},
+			rules: []string{"unchecked"},
+		},
+		{
+			name:  "eql with a time range filter",
+			input: &EQLInput{esTarget: target, Index: "logs", Query: map[string]interface{}{"query": "process where true", "size": 10, "filter": map[string]interface{}{"range": map[string]interface{}{"@timestamp": map[string]interface{}{"gte": "now-1h"}}}}},
+		},
+		{
+			name:  "eql statement without a filter",
+			input: &EQLInput{esTarget: target, Index: "logs", Query: "process where process.name == \"x\""},
+			rules: []string{"time_range"},
+		},
+		{
+			name:  "eql with a wide filter on a banned index",
+			input: &EQLInput{esTarget: target, Index: "_all", Query: map[string]interface{}{"query": "any where true", "size": 1000, "filter": map[string]interface{}{"range": map[string]interface{}{"@timestamp": map[string]interface{}{"gte": "now-30d"}}}}},
+			rules: []string{"index", "max_time_range", "size"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.input.Init(""); err != nil {
+				t.Fatal(err)
+			}
+			a := Alert{Name: "1", Source: Input{Inputer: tt.input}}
+			violations, err := a.CheckPolicy(context.Background(), time.Now())
+			if err != nil {
+				t.Fatal(err)
+			}
+			var rules []string
+			for _, v := range violations {
+				rules = append(rules, v.Rule)
+			}
+			sort.Strings(rules)
+			if !reflect.DeepEqual(rules, tt.rules) {
+				t.Errorf("violations %v, want %v", violations, tt.rules)
+			}
+		})
+	}
+}
@@ -0,0 +1,160 @@
+package alert
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+)
+
+// Query is the simplified form of a search: a time frame, filters, groups
+// and a metric, which Compile turns into query dsl. On an alert its fields
+// sit next to index, and they are also accepted by search inputs
+type Query struct {
+	Timeframe string      `yaml:"timeframe" mapstructure:"timeframe"`   // e.g. "5m", searches from now-5m to now
+	TimeField string      `yaml:"time_field" mapstructure:"time_field"` // default @timestamp
+	Filter    interface{} `yaml:"filter" mapstructure:"filter"`         // lucene query string, or a field: value map
+	GroupBy   interface{} `yaml:"group_by" mapstructure:"group_by"`     // field, or list of fields for nested groups
+	GroupSize int         `yaml:"group_size" mapstructure:"group_size"` // buckets per group, default 10
+	Metric    *Metric     `yaml:"metric" mapstructure:"metric"`
+}
+
+// Metric is computed over the documents of every group, it is the "metric"
+// aggregation. Type count uses the doc count and adds no aggregation
+type Metric struct {
+	Type     string    `yaml:"type" mapstructure:"type"` // avg, sum, min, max, cardinality, value_count, percentiles or count
+	Field    string    `yaml:"field" mapstructure:"field"`
+	Percents []float64 `yaml:"percents" mapstructure:"percents"` // of percentiles
+}
+
+var timeframeRe = regexp.MustCompile(`^[0-9]+(ms|s|m|h|d|w)$`)
+
+var metricTypes = map[string]bool{
+	"avg": true, "sum": true, "min": true, "max": true,
+	"cardinality": true, "value_count": true, "percentiles": true, "count": true,
+}
+
+// Empty tells whether none of the builder fields is set
+func (q Query) Empty() bool {
+	return q.Timeframe == "" && q.Filter == nil && q.GroupBy == nil && q.Metric == nil
+}
+
+// Compile returns the query dsl of q: a bool filter with the time range and
+// the filters, and "group_by" terms aggregations, nested for every field,
+// around the "metric" aggregation
+func (q Query) Compile() (Dict, error) {
+	if q.Timeframe == "" {
+		return nil, errors.New("timeframe is required")
+	}
+	if !timeframeRe.MatchString(q.Timeframe) {
+		return nil, fmt.Errorf("invalid timeframe %q, e.g. 30s, 5m, 1h or 1d", q.Timeframe)
+	}
+	timeField := q.TimeField
+	if timeField == "" {
+		timeField = "@timestamp"
+	}
+
+	filters := []interface{}{
+		Dict{"range": Dict{timeField: Dict{"gte": "now-" + q.Timeframe, "lte": "now"}}},
+	}
+	switch f := q.Filter.(type) {
+	case nil:
+	case string:
+		if f != "" {
+			filters = append(filters, Dict{"query_string": Dict{"query": f}})
+		}
+	default:
+		m, err := toStringMap(f)
+		if err != nil {
+			return nil, fmt.Errorf("filter: %s", err)
+		}
+		keys := make([]string, 0, len(m))
+		for k := range m {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			if vs, ok := m[k].([]interface{}); ok {
+				filters = append(filters, Dict{"terms": Dict{k: vs}})
+			} else {
+				filters = append(filters, Dict{"term": Dict{k: m[k]}})
+			}
+		}
+	}
+
+	body := Dict{
+		"size":  0,
+		"query": Dict{"bool": Dict{"filter": filters}},
+	}
+
+	var aggs Dict
+	if q.Metric != nil {
+		if !metricTypes[q.Metric.Type] {
+			return nil, fmt.Errorf("unknown metric type: %q", q.Metric.Type)
+		}
+		if q.Metric.Type != "count" {
+			if q.Metric.Field == "" {
+				return nil, errors.New("metric field is required")
+			}
+			m := Dict{"field": q.Metric.Field}
+			if q.Metric.Type == "percentiles" && len(q.Metric.Percents) > 0 {
+				m["percents"] = q.Metric.Percents
+			}
+			aggs = Dict{"metric": Dict{q.Metric.Type: m}}
+		}
+	}
+
+	groups, err := toStrings(q.GroupBy)
+	if err != nil {
+		return nil, fmt.Errorf("group_by: %s", err)
+	}
+	size := q.GroupSize
+	if size == 0 {
+		size = 10
+	}
+	for i := len(groups) - 1; i >= 0; i-- {
+		g := Dict{"terms": Dict{"field": groups[i], "size": size}}
+		if aggs != nil {
+			g["aggs"] = aggs
+		}
+		aggs = Dict{"group_by": g}
+	}
+	if aggs != nil {
+		body["aggs"] = aggs
+	}
+	return body, nil
+}
+
+func toStringMap(v interface{}) (map[string]interface{}, error) {
+	switch m := v.(type) {
+	case Dict:
+		return m, nil
+	case map[string]interface{}:
+		return m, nil
+	case map[interface{}]interface{}:
+		return mapToDict(m)
+	}
+	return nil, errors.New("must be a query string or a field: value map")
+}
+
+func toStrings(v interface{}) ([]string, error) {
+	switch s := v.(type) {
+	case nil:
+		return nil, nil
+	case string:
+		return []string{s}, nil
+	case []interface{}:
+		out := make([]string, len(s))
+		for i := range s {
+			str, ok := s[i].(string)
+			if !ok {
+				return nil, errors.New("must be a field or a list of fields")
+			}
+			out[i] = str
+		}
+		return out, nil
+	case []string:
+		return s, nil
+	}
+	return nil, errors.New("must be a field or a list of fields")
+}
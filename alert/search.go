@@ -2,15 +2,16 @@ package alert
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
-	"io/ioutil"
-	"net/http"
+	"strings"
 	"time"
 
 	"go.uber.org/zap"
 	"github.com/CheerChen/esalert/logger"
+	"github.com/CheerChen/esalert/tenant"
 )
 
 type Hit struct {
@@ -19,30 +20,205 @@ type Hit struct {
 	ID     string                 `json:"_id"`     // The unique id of the document
 	Score  float64                `json:"_score"`  // The document's score relative to the search
 	Source map[string]interface{} `json:"_source"` // The actual document
+	Sort   []interface{}          `json:"sort"`    // Sort values, used to page with search_after
 }
 
 type HitInfo struct {
-	HitCount    uint64  `json:"total"`     // The total number of documents matched
-	HitMaxScore float64 `json:"max_score"` // The maximum score of all the documents matched
-	Hits        []Hit   `json:"hits"`      // The actual documents matched
+	HitCount         uint64  `json:"-"`         // The total number of documents matched, see Result.UnmarshalJSON
+	HitCountRelation string  `json:"-"`         // "eq" if HitCount is exact, "gte" if it is a lower bound
+	HitMaxScore      float64 `json:"max_score"` // The maximum score of all the documents matched
+	Hits             []Hit   `json:"hits"`      // The actual documents matched, every page of them with paginate
+	HitsTruncated    bool    `json:"-"`         // paginate stopped at max_docs before collecting every hit
 }
 
 type Result struct {
-	TookMS       uint64 `json:"took"`                         // Time search took to complete, in milliseconds
-	TimedOut     bool   `json:"timed_out"`                    // Whether or not the search timed out
-	HitInfo      `json:"hits" luautil:",inline"`              // Information related to the actual hits
-	Aggregations map[string]interface{} `json:"aggregations"` // Information related to aggregations in the query
+	TookMS       uint64                          `json:"took"`      // Time search took to complete, in milliseconds
+	TimedOut     bool                            `json:"timed_out"` // Whether or not the search timed out
+	Shards       ShardInfo                       `json:"_shards"`   // How many shards answered, Failed > 0 means partial results
+	HitInfo      `json:"hits" luautil:",inline"` // Information related to the actual hits
+	Aggregations map[string]interface{}          `json:"aggregations"` // Information related to aggregations in the query
+	Payload      interface{}                     `json:"-"`            // Data of inputs other than search and count
+	Series       []Series                        `json:"-"`            // Series of prometheus inputs
+	SeriesType   string                          `json:"-"`            // vector, matrix or scalar
+	Table        Table                           `json:"-"`            // Columns and rows of elasticsearch sql inputs
+	Sequences    []Sequence                      `json:"-"`            // Sequences matched by eql inputs
+	ScrollId     string                          `json:"_scroll_id" luautil:"-"`
+	PitId        string                          `json:"pit_id" luautil:"-"`
+	Cache        string                          `json:"-" luautil:"-"` // "hit" or "miss" when the cluster caches results
+}
+
+// UnmarshalJSON decodes a search response of any supported version.
+// Elasticsearch 5 and 6 send hits.total as a number, 7+ and OpenSearch as
+// {"value": n, "relation": "eq"|"gte"}, and leave it out entirely when
+// track_total_hits is false
+func (r *Result) UnmarshalJSON(b []byte) error {
+	type plain Result
+	if err := json.Unmarshal(b, (*plain)(r)); err != nil {
+		return err
+	}
+
+	var raw struct {
+		Hits struct {
+			Total json.RawMessage `json:"total"`
+		} `json:"hits"`
+	}
+	if err := json.Unmarshal(b, &raw); err != nil {
+		return err
+	}
+	total := bytes.TrimSpace(raw.Hits.Total)
+	switch {
+	case len(total) == 0 || string(total) == "null":
+		r.HitCount, r.HitCountRelation = 0, ""
+	case total[0] == '{':
+		var t struct {
+			Value    uint64 `json:"value"`
+			Relation string `json:"relation"`
+		}
+		if err := json.Unmarshal(total, &t); err != nil {
+			return fmt.Errorf("hits.total: %s", err)
+		}
+		r.HitCount, r.HitCountRelation = t.Value, t.Relation
+	default:
+		if err := json.Unmarshal(total, &r.HitCount); err != nil {
+			return fmt.Errorf("hits.total: %s", err)
+		}
+		r.HitCountRelation = "eq"
+	}
+	return nil
 }
 
 type Context struct {
 	Name      string
 	StartedTS uint64
 	Result    `luautil:",inline"`
+	Results   map[string]Result // of the named searches
 	time.Time `luautil:"-"`
 }
 
-type elasticError struct {
-	Error string `json:"reason"`
+// ErrorCause is a single cause in an elasticsearch error
+type ErrorCause struct {
+	Type   string `json:"type"`
+	Reason string `json:"reason"`
+	Index  string `json:"index"`
+}
+
+func (c ErrorCause) String() string {
+	if c.Type == "" {
+		return c.Reason
+	}
+	return c.Type + ": " + c.Reason
+}
+
+type ShardFailure struct {
+	Shard  int        `json:"shard"`
+	Index  string     `json:"index"`
+	Node   string     `json:"node"`
+	Reason ErrorCause `json:"reason"`
+}
+
+type ShardInfo struct {
+	Total      int            `json:"total"`
+	Successful int            `json:"successful"`
+	Skipped    int            `json:"skipped"`
+	Failed     int            `json:"failed"`
+	Failures   []ShardFailure `json:"failures"`
+}
+
+// Partial tells whether some shards failed to answer
+func (s ShardInfo) Partial() bool {
+	return s.Failed > 0
+}
+
+// Reasons returns the distinct reasons of the shard failures
+func (s ShardInfo) Reasons() []string {
+	return shardReasons(s.Failures)
+}
+
+func shardReasons(failures []ShardFailure) []string {
+	var reasons []string
+	seen := make(map[string]bool)
+	for _, f := range failures {
+		r := f.Reason.String()
+		if !seen[r] {
+			seen[r] = true
+			reasons = append(reasons, r)
+		}
+	}
+	return reasons
+}
+
+// ElasticError is the error envelope elasticsearch answers with on non-200
+// responses
+type ElasticError struct {
+	Status       int
+	Type         string
+	Reason       string
+	RootCause    []ErrorCause
+	FailedShards []ShardFailure
+}
+
+func (e *ElasticError) Error() string {
+	msg := fmt.Sprintf("HTTP status code: %v", e.Status)
+	if e.Reason != "" {
+		msg += ": " + ErrorCause{Type: e.Type, Reason: e.Reason}.String()
+	}
+	for _, c := range e.RootCause {
+		if c.Type != e.Type || c.Reason != e.Reason {
+			msg += "; root cause: " + c.String()
+		}
+	}
+	for _, r := range shardReasons(e.FailedShards) {
+		msg += "; shard failure: " + r
+	}
+	return msg
+}
+
+// parseElasticError decodes the error body of a non-200 response. Very old
+// versions send "error" as a plain string, anything which is not json is
+// kept as the reason
+func parseElasticError(status int, body []byte) *ElasticError {
+	e := &ElasticError{Status: status}
+	var envelope struct {
+		Error json.RawMessage `json:"error"`
+	}
+	if err := json.Unmarshal(body, &envelope); err != nil || len(envelope.Error) == 0 {
+		reason := string(bytes.TrimSpace(body))
+		if len(reason) > 200 {
+			reason = reason[:200] + "..."
+		}
+		e.Reason = reason
+		return e
+	}
+
+	var details struct {
+		Type         string         `json:"type"`
+		Reason       string         `json:"reason"`
+		RootCause    []ErrorCause   `json:"root_cause"`
+		FailedShards []ShardFailure `json:"failed_shards"`
+	}
+	if err := json.Unmarshal(envelope.Error, &details); err != nil {
+		json.Unmarshal(envelope.Error, &e.Reason)
+		return e
+	}
+	e.Type = details.Type
+	e.Reason = details.Reason
+	e.RootCause = details.RootCause
+	e.FailedShards = details.FailedShards
+	return e
+}
+
+// PartialError is returned for searches with failed shards when the alert
+// does not accept partial results
+type PartialError struct {
+	Shards ShardInfo
+}
+
+func (e *PartialError) Error() string {
+	msg := fmt.Sprintf("partial results: %d of %d shards failed", e.Shards.Failed, e.Shards.Total)
+	if reasons := e.Shards.Reasons(); len(reasons) > 0 {
+		msg += ": " + strings.Join(reasons, "; ")
+	}
+	return msg
 }
 
 // Dict represents a key-value map which may be unmarshalled from a yaml
@@ -99,63 +275,96 @@ func mapToDict(m map[interface{}]interface{}) (Dict, error) {
 	return d, nil
 }
 
+// PingSearch checks that the elasticsearch node at u answers, using the
+// search credentials of the tenant running ctx
+func PingSearch(ctx context.Context, u string) error {
+	ctx, cancel := context.WithTimeout(ctx, 2*time.Second)
+	defer cancel()
+	return adhocCluster(ctx).ping(ctx, u)
+}
+
 // Search performs a search against the given elasticsearch index for
 // documents of the given type. The search must json marshal into a valid
 // elasticsearch request body query
 // (see https://www.elastic.co/guide/en/elasticsearch/reference/current/search-request-body.html)
-func Search(u string, query interface{}) (Result, error) {
-	bodyReq, err := json.Marshal(query)
+func Search(ctx context.Context, u string, query interface{}) (Result, error) {
+	return search(ctx, adhocCluster(ctx), u, query)
+}
+
+// SearchCluster performs a search like Search against index on the named
+// cluster of the tenant running ctx
+func SearchCluster(ctx context.Context, name, index string, query interface{}) (Result, error) {
+	cl, err := lookupCluster(tenant.FromContext(ctx), name)
 	if err != nil {
 		return Result{}, err
 	}
-	method := "POST"
-	logger.Info("search build request",
-		zap.String("method", method),
-		zap.String("url", u),
-		zap.String("body", string(bodyReq)),
-	)
-	req, err := http.NewRequest(method, u, bytes.NewBuffer(bodyReq))
+	return search(ctx, cl, index+"/_search", query)
+}
+
+func search(ctx context.Context, cl *cluster, path string, query interface{}) (Result, error) {
+	body, err := json.Marshal(query)
 	if err != nil {
 		return Result{}, err
 	}
-	req.Header.Add("Accept", "application/json")
-	req.Header.Set("Content-Type", "application/json")
-
-	//req.SetBasicAuth(config.Opts.ElasticSearchUser, config.Opts.ElasticSearchPass)
-	client := &http.Client{
-		Timeout: time.Duration(5 * time.Second),
-	}
-	resp, err := client.Do(req)
+	raw, err := cl.searchRaw(ctx, path, body)
 	if err != nil {
 		return Result{}, err
 	}
-	defer resp.Body.Close()
+	return decodeResult(raw)
+}
 
-	body, err := ioutil.ReadAll(resp.Body)
+// searchRaw posts body to path and returns the response undecoded, non-200
+// responses are returned as *ElasticError
+func (cl *cluster) searchRaw(ctx context.Context, path string, body []byte) ([]byte, error) {
+	status, raw, err := cl.request(ctx, "POST", path, body)
 	if err != nil {
-		return Result{}, err
+		return nil, err
 	}
-
-	logger.Info("search results",
-		zap.String("body", string(body)),
-	)
-
-	if resp.StatusCode != 200 {
-		var e elasticError
-		if err := json.Unmarshal(body, &e); err != nil {
-			logger.Error("could not unmarshal error body", zap.String("err", err.Error()))
-			return Result{}, err
-		}
-		return Result{}, errors.New(fmt.Sprintf("HTTP status code: %v", resp.StatusCode))
+	if status != 200 {
+		return nil, parseElasticError(status, raw)
 	}
+	return raw, nil
+}
 
+// decodeResult decodes a search response, a search which timed out is
+// returned along with an error
+func decodeResult(raw []byte) (Result, error) {
 	var result Result
-	if err := json.Unmarshal(body, &result); err != nil {
+	if err := json.Unmarshal(raw, &result); err != nil {
 		logger.Error("could not unmarshal query result", zap.String("err", err.Error()))
 		return result, err
-	} else if result.TimedOut {
-		return result, errors.New("query timed out in elastic query")
 	}
-
+	if result.TimedOut {
+		return result, errTimedOut
+	}
 	return result, nil
 }
+
+var errTimedOut = errors.New("query timed out in elastic query")
+
+// do sends in as json to path on the cluster and decodes the response into
+// out, non-200 responses are returned as *ElasticError
+func (cl *cluster) do(ctx context.Context, method, path string, in, out interface{}) error {
+	var bodyReq []byte
+	if in != nil {
+		var err error
+		if bodyReq, err = json.Marshal(in); err != nil {
+			return err
+		}
+	}
+	status, body, err := cl.request(ctx, method, path, bodyReq)
+	if err != nil {
+		return err
+	}
+	if status != 200 {
+		return parseElasticError(status, body)
+	}
+	if out == nil {
+		return nil
+	}
+	if err := json.Unmarshal(body, out); err != nil {
+		logger.Error("could not unmarshal query result", zap.String("err", err.Error()))
+		return err
+	}
+	return nil
+}
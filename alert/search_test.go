@@ -0,0 +1,147 @@
+package alert
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestResultUnmarshalJSON(t *testing.T) {
+	tests := []struct {
+		name     string
+		body     string
+		count    uint64
+		relation string
+		shards   ShardInfo
+	}{
+		{
+			name:     "es5 total as a number",
+			body:     `{"took":3,"timed_out":false,"_shards":{"total":5,"successful":5,"failed":0},"hits":{"total":42,"max_score":1.0,"hits":[]}}`,
+			count:    42,
+			relation: "eq",
+			shards:   ShardInfo{Total: 5, Successful: 5},
+		},
+		{
+			name:     "es6 total as a number with skipped shards",
+			body:     `{"took":3,"timed_out":false,"_shards":{"total":5,"successful":5,"skipped":2,"failed":0},"hits":{"total":7,"max_score":null,"hits":[]}}`,
+			count:    7,
+			relation: "eq",
+			shards:   ShardInfo{Total: 5, Successful: 5, Skipped: 2},
+		},
+		{
+			name:     "es7 total as an exact object",
+			body:     `{"took":1,"timed_out":false,"_shards":{"total":1,"successful":1,"skipped":0,"failed":0},"hits":{"total":{"value":9,"relation":"eq"},"max_score":null,"hits":[]}}`,
+			count:    9,
+			relation: "eq",
+			shards:   ShardInfo{Total: 1, Successful: 1},
+		},
+		{
+			name:     "es8 total as a lower bound",
+			body:     `{"took":12,"timed_out":false,"_shards":{"total":3,"successful":3,"skipped":0,"failed":0},"hits":{"total":{"value":10000,"relation":"gte"},"max_score":null,"hits":[]}}`,
+			count:    10000,
+			relation: "gte",
+			shards:   ShardInfo{Total: 3, Successful: 3},
+		},
+		{
+			name:     "opensearch total left out with track_total_hits false",
+			body:     `{"took":2,"timed_out":false,"_shards":{"total":2,"successful":2,"skipped":0,"failed":0},"hits":{"max_score":null,"hits":[]}}`,
+			count:    0,
+			relation: "",
+			shards:   ShardInfo{Total: 2, Successful: 2},
+		},
+		{
+			name:     "es7 partial results with shard failures",
+			body:     `{"took":5,"timed_out":false,"_shards":{"total":2,"successful":1,"skipped":0,"failed":1,"failures":[{"shard":0,"index":"logs-1","node":"n1","reason":{"type":"query_shard_exception","reason":"failed to create query"}}]},"hits":{"total":{"value":3,"relation":"eq"},"hits":[]}}`,
+			count:    3,
+			relation: "eq",
+			shards: ShardInfo{Total: 2, Successful: 1, Failed: 1, Failures: []ShardFailure{{
+				Shard:  0,
+				Index:  "logs-1",
+				Node:   "n1",
+				Reason: ErrorCause{Type: "query_shard_exception", Reason: "failed to create query"},
+			}}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var r Result
+			if err := json.Unmarshal([]byte(tt.body), &r); err != nil {
+				t.Fatal(err)
+			}
+			if r.HitCount != tt.count || r.HitCountRelation != tt.relation {
+				t.Errorf("hits.total = %d %q, want %d %q", r.HitCount, r.HitCountRelation, tt.count, tt.relation)
+			}
+			if !reflect.DeepEqual(r.Shards, tt.shards) {
+				t.Errorf("_shards = %+v, want %+v", r.Shards, tt.shards)
+			}
+		})
+	}
+}
+
+func TestParseElasticError(t *testing.T) {
+	tests := []struct {
+		name   string
+		status int
+		body   string
+		want   ElasticError
+		msg    string
+	}{
+		{
+			name:   "es1 error as a string",
+			status: 400,
+			body:   `{"error":"SearchPhaseExecutionException[Failed to execute phase [query]]","status":400}`,
+			want:   ElasticError{Status: 400, Reason: "SearchPhaseExecutionException[Failed to execute phase [query]]"},
+			msg:    "HTTP status code: 400: SearchPhaseExecutionException[Failed to execute phase [query]]",
+		},
+		{
+			name:   "es7 error object with root cause",
+			status: 404,
+			body:   `{"error":{"root_cause":[{"type":"index_not_found_exception","reason":"no such index [x]","index":"x"}],"type":"index_not_found_exception","reason":"no such index [x]","index":"x"},"status":404}`,
+			want: ElasticError{
+				Status:    404,
+				Type:      "index_not_found_exception",
+				Reason:    "no such index [x]",
+				RootCause: []ErrorCause{{Type: "index_not_found_exception", Reason: "no such index [x]", Index: "x"}},
+			},
+			msg: "HTTP status code: 404: index_not_found_exception: no such index [x]",
+		},
+		{
+			name:   "es8 error object with failed shards",
+			status: 400,
+			body:   `{"error":{"root_cause":[{"type":"query_shard_exception","reason":"failed to create query"}],"type":"search_phase_execution_exception","reason":"all shards failed","failed_shards":[{"shard":0,"index":"logs-1","node":"n1","reason":{"type":"query_shard_exception","reason":"failed to create query"}}]},"status":400}`,
+			want: ElasticError{
+				Status:    400,
+				Type:      "search_phase_execution_exception",
+				Reason:    "all shards failed",
+				RootCause: []ErrorCause{{Type: "query_shard_exception", Reason: "failed to create query"}},
+				FailedShards: []ShardFailure{{
+					Shard:  0,
+					Index:  "logs-1",
+					Node:   "n1",
+					Reason: ErrorCause{Type: "query_shard_exception", Reason: "failed to create query"},
+				}},
+			},
+			msg: "HTTP status code: 400: search_phase_execution_exception: all shards failed; root cause: query_shard_exception: failed to create query; shard failure: query_shard_exception: failed to create query",
+		},
+		{
+			name:   "proxy answering with plain text",
+			status: 502,
+			body:   "Bad Gateway\n",
+			want:   ElasticError{Status: 502, Reason: "Bad Gateway"},
+			msg:    "HTTP status code: 502: Bad Gateway",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := parseElasticError(tt.status, []byte(tt.body))
+			if !reflect.DeepEqual(*e, tt.want) {
+				t.Errorf("parseElasticError = %+v, want %+v", *e, tt.want)
+			}
+			if e.Error() != tt.msg {
+				t.Errorf("Error() = %q, want %q", e.Error(), tt.msg)
+			}
+		})
+	}
+}
@@ -43,13 +43,7 @@ func (self FullTimeSpec) Next(now time.Time) time.Time {
 	var month = time.Hour * 24 * 30
 	var max = now.Add(1 * month)
 	for next := now; next.Before(max); next = next.Add(time.Second) {
-		a := self.Sec.Satisfied(next.Second()) &&
-			self.Min.Satisfied(next.Minute()) &&
-			self.Hour.Satisfied(next.Hour()) &&
-			self.Wday.Satisfied(weekdayToInt(next.Weekday())) &&
-			self.Mday.Satisfied(next.Day()) &&
-			self.Mon.Satisfied(monthToInt(next.Month()))
-		if a {
+		if self.matches(next) {
 			return next
 		}
 	}
@@ -57,6 +51,40 @@ func (self FullTimeSpec) Next(now time.Time) time.Time {
 	return now
 }
 
+// MinInterval returns the shortest gap between two fire times within window
+// after from, or 0 if the spec does not fire twice within it. Every second of
+// the window is checked, a week covers every combination of seconds,
+// minutes, hours and weekdays
+func (self FullTimeSpec) MinInterval(from time.Time, window time.Duration) time.Duration {
+	var min time.Duration
+	var prev time.Time
+	end := from.Add(window)
+	for t := from.Truncate(time.Second); t.Before(end); t = t.Add(time.Second) {
+		if !self.matches(t) {
+			continue
+		}
+		if !prev.IsZero() {
+			if gap := t.Sub(prev); min == 0 || gap < min {
+				min = gap
+			}
+			if min == time.Second {
+				break
+			}
+		}
+		prev = t
+	}
+	return min
+}
+
+func (self FullTimeSpec) matches(t time.Time) bool {
+	return self.Sec.Satisfied(t.Second()) &&
+		self.Min.Satisfied(t.Minute()) &&
+		self.Hour.Satisfied(t.Hour()) &&
+		self.Wday.Satisfied(weekdayToInt(t.Weekday())) &&
+		self.Mday.Satisfied(t.Day()) &&
+		self.Mon.Satisfied(monthToInt(t.Month()))
+}
+
 func weekdayToInt(d time.Weekday) int {
 	switch d {
 	case time.Sunday:
@@ -0,0 +1,146 @@
+package controllers
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+
+	"github.com/CheerChen/esalert/logger"
+	"github.com/CheerChen/esalert/models"
+	"github.com/CheerChen/esalert/redact"
+)
+
+const (
+	AuditCreate   = "create"
+	AuditUpdate   = "update"
+	AuditTrigger  = "trigger"
+	AuditStop     = "stop"
+	AuditRollback = "rollback"
+	AuditLimits   = "limits" // cluster limits changed, job id 0
+)
+
+// audit records a configuration or control action performed by the caller.
+// before and after are stored as json, nil is stored as an empty string
+func audit(c *gin.Context, action string, jobId int64, before, after interface{}) {
+	a := models.Audit{
+		TenantId: currentToken(c).TenantId,
+		UserId:   currentToken(c).UserId,
+		JobId:    jobId,
+		Action:   action,
+		Ip:       clientIP(c),
+		Before:   auditPayload(before),
+		After:    auditPayload(after),
+	}
+	if err := models.AddAudit(a); err != nil {
+		logger.Error("failed to write audit log",
+			zap.Int64("id", jobId),
+			zap.String("action", action),
+			zap.String("err", err.Error()),
+		)
+	}
+}
+
+// clientIP returns the address of the caller. Forwarded headers are only
+// believed when the request comes from one of the TrustedProxies, the
+// caller is then the right-most X-Forwarded-For address which isn't a
+// trusted proxy itself
+func clientIP(c *gin.Context) string {
+	remote, _, err := net.SplitHostPort(c.Request.RemoteAddr)
+	if err != nil {
+		remote = c.Request.RemoteAddr
+	}
+	if !trustedProxy(remote) {
+		return remote
+	}
+	if xff := c.GetHeader("X-Forwarded-For"); xff != "" {
+		hops := strings.Split(xff, ",")
+		for i := len(hops) - 1; i >= 0; i-- {
+			ip := strings.TrimSpace(hops[i])
+			if i == 0 || !trustedProxy(ip) {
+				return ip
+			}
+		}
+	}
+	if ip := strings.TrimSpace(c.GetHeader("X-Real-Ip")); ip != "" {
+		return ip
+	}
+	return remote
+}
+
+func trustedProxy(addr string) bool {
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return false
+	}
+	for _, n := range trustedProxies {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func auditPayload(v interface{}) string {
+	if v == nil {
+		return ""
+	}
+	b, err := json.Marshal(v)
+	if err != nil {
+		return ""
+	}
+	return string(b)
+}
+
+type AuditController struct{}
+
+// List returns audit entries, filtered by the user_id, job_id, action, ip,
+// since, until, limit and offset query parameters. Entries never leave the
+// caller's tenant, and non-admin callers only see their own entries
+func (ctrl AuditController) List(c *gin.Context) {
+	f := models.AuditFilter{
+		TenantId: currentToken(c).TenantId,
+		UserId:   c.Query("user_id"),
+		JobId:    c.Query("job_id"),
+		Action:   c.Query("action"),
+		Ip:       c.Query("ip"),
+		Since:    c.Query("since"),
+		Until:    c.Query("until"),
+		Limit:    100,
+	}
+	if scope := currentScope(c); scope.UserId != "" {
+		f.UserId = scope.UserId
+	}
+	if l, err := strconv.Atoi(c.Query("limit")); err == nil && l > 0 && l <= 1000 {
+		f.Limit = l
+	}
+	if o, err := strconv.Atoi(c.Query("offset")); err == nil && o > 0 {
+		f.Offset = o
+	}
+
+	audits, err := models.GetAudits(f)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"msg":   "failed to access db",
+			"error": err.Error(),
+		})
+		return
+	}
+	// payloads are stored as is so rollback can restore them, and only
+	// redacted on the way out
+	for i := range audits {
+		if audits[i].Before != "" {
+			audits[i].Before = string(redact.JSON([]byte(audits[i].Before)))
+		}
+		if audits[i].After != "" {
+			audits[i].After = string(redact.JSON([]byte(audits[i].After)))
+		}
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"list": audits,
+	})
+}
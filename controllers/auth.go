@@ -0,0 +1,165 @@
+package controllers
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+
+	"github.com/CheerChen/esalert/logger"
+	"github.com/CheerChen/esalert/models"
+)
+
+const (
+	RoleViewer = "viewer" // may read jobs of its own user
+	RoleOwner  = "owner"  // may manage jobs of its own user
+	RoleAdmin  = "admin"  // may manage every job
+
+	tokenKey = "token"
+)
+
+// HashToken returns the form in which api tokens are stored in alert_token
+func HashToken(raw string) string {
+	sum := sha256.Sum256([]byte(raw))
+	return hex.EncodeToString(sum[:])
+}
+
+// Auth resolves the api token sent as "Authorization: Bearer <token>" or
+// "X-Api-Token: <token>", and aborts the request if it is missing or unknown
+func Auth() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		raw := c.GetHeader("X-Api-Token")
+		if h := c.GetHeader("Authorization"); raw == "" && strings.HasPrefix(h, "Bearer ") {
+			raw = strings.TrimSpace(strings.TrimPrefix(h, "Bearer "))
+		}
+		if raw == "" {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{
+				"msg": "api token required",
+			})
+			return
+		}
+
+		token, err := models.GetTokenByHash(HashToken(raw))
+		if err != nil {
+			if err != sql.ErrNoRows {
+				logger.Error("failed to look up api token", zap.String("err", err.Error()))
+			}
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{
+				"msg": "invalid api token",
+			})
+			return
+		}
+		c.Set(tokenKey, token)
+		c.Next()
+	}
+}
+
+// RequireRole aborts the request unless the token resolved by Auth has one
+// of the given roles
+func RequireRole(roles ...string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		token := currentToken(c)
+		for _, role := range roles {
+			if token.Role == role {
+				c.Next()
+				return
+			}
+		}
+		c.AbortWithStatusJSON(http.StatusForbidden, gin.H{
+			"msg": "permission denied",
+		})
+	}
+}
+
+func currentToken(c *gin.Context) models.Token {
+	v, _ := c.Get(tokenKey)
+	token, _ := v.(models.Token)
+	return token
+}
+
+// currentScope limits job queries to the caller's tenant and own jobs, admins
+// see every job of their tenant
+func currentScope(c *gin.Context) models.Scope {
+	token := currentToken(c)
+	if token.Role == RoleAdmin {
+		return models.Scope{TenantId: token.TenantId}
+	}
+	return models.Scope{TenantId: token.TenantId, UserId: token.UserId}
+}
+
+type TokenController struct{}
+
+type tokenForm struct {
+	UserId string `json:"user_id" binding:"required"`
+	Name   string `json:"name"`
+	Role   string `json:"role" binding:"required"`
+}
+
+// Create issues a new api token within the caller's tenant, the raw token is
+// only returned once
+func (ctrl TokenController) Create(c *gin.Context) {
+	var form tokenForm
+	if err := c.ShouldBindJSON(&form); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"msg":   "invalid token form",
+			"error": err.Error(),
+		})
+		return
+	}
+	switch form.Role {
+	case RoleViewer, RoleOwner, RoleAdmin:
+	default:
+		c.JSON(http.StatusBadRequest, gin.H{
+			"msg": "unknown role",
+		})
+		return
+	}
+
+	b := make([]byte, 24)
+	if _, err := rand.Read(b); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"msg":   "failed to generate token",
+			"error": err.Error(),
+		})
+		return
+	}
+	raw := hex.EncodeToString(b)
+
+	id, err := models.AddToken(models.Token{
+		TenantId:  currentToken(c).TenantId,
+		UserId:    form.UserId,
+		Name:      form.Name,
+		Role:      form.Role,
+		TokenHash: HashToken(raw),
+	})
+	if err != nil {
+		c.JSON(http.StatusNotAcceptable, gin.H{
+			"msg":   "failed to save token",
+			"error": err.Error(),
+		})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"id":    id,
+		"token": raw,
+	})
+}
+
+// Delete revokes an api token of the caller's tenant
+func (ctrl TokenController) Delete(c *gin.Context) {
+	if err := models.DelTokenById(c.Param("id"), currentToken(c).TenantId); err != nil {
+		c.JSON(http.StatusNotAcceptable, gin.H{
+			"msg":   "failed to revoke token",
+			"error": err.Error(),
+		})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"msg": "revoke ok",
+	})
+}
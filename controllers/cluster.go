@@ -0,0 +1,54 @@
+package controllers
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+
+	"github.com/CheerChen/esalert/alert"
+	"github.com/CheerChen/esalert/logger"
+)
+
+type ClusterController struct{}
+
+// Limits returns the rate limits of every cluster the caller's tenant may
+// search, along with the requests in flight and queued
+func (ctrl ClusterController) Limits(c *gin.Context) {
+	c.JSON(http.StatusOK, alert.ClusterLimitsOf(currentToken(c).TenantId))
+}
+
+// SetLimits changes the rate limits of a cluster until the next restart.
+// Fields left out of the body keep their current value
+func (ctrl ClusterController) SetLimits(c *gin.Context) {
+	tenantId, name := currentToken(c).TenantId, c.Param("name")
+	before, ok := alert.ClusterLimitsOf(tenantId)[name]
+	if !ok {
+		c.JSON(http.StatusNotFound, gin.H{
+			"msg": "cluster not found",
+		})
+		return
+	}
+	limits := before.ClusterLimits
+	if err := c.ShouldBindJSON(&limits); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"msg":   "invalid limits form",
+			"error": err.Error(),
+		})
+		return
+	}
+	if err := alert.SetClusterLimits(tenantId, name, limits); err != nil {
+		c.JSON(http.StatusNotAcceptable, gin.H{
+			"msg":   "failed to set limits",
+			"error": err.Error(),
+		})
+		return
+	}
+	logger.Info("cluster limits changed",
+		zap.String("cluster", name),
+		zap.Float64("rate_limit", limits.RateLimit),
+		zap.Int("max_concurrent", limits.MaxConcurrent),
+	)
+	audit(c, AuditLimits, 0, before.ClusterLimits, limits)
+	c.JSON(http.StatusOK, alert.ClusterLimitsOf(tenantId)[name])
+}
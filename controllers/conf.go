@@ -0,0 +1,76 @@
+package controllers
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/koding/multiconfig"
+
+	"github.com/CheerChen/esalert/tenant"
+)
+
+type ServerConf struct {
+	Scheduler SchedulerConf
+	Tenant    map[string]TenantConf
+	// TrustedProxies are the addresses or cidrs of the reverse proxies whose
+	// X-Forwarded-For and X-Real-Ip headers are believed, see clientIP
+	TrustedProxies []string
+}
+
+// SchedulerConf sizes the global worker pool shared by every tenant
+type SchedulerConf struct {
+	Workers  int `default:"20"`
+	MaxQueue int `default:"100"` // queued runs per tenant before new ones are rejected
+	MaxWait  int `default:"60"`  // seconds a run may stay queued before it is rejected
+}
+
+// TenantConf holds the limits of a single tenant, see [Tenant.<name>].
+// Zero means unlimited
+type TenantConf struct {
+	MaxJobs           int // jobs, checked when a job is saved
+	MinInterval       int // seconds between two runs of a job, checked when a job is saved and by the scheduler
+	MaxConcurrent     int // runs executing at the same time
+	SearchesPerMinute int // elasticsearch requests within any minute, every input and page counted
+
+	// limits of every single user of the tenant
+	UserMaxJobs           int
+	UserMaxConcurrent     int
+	UserSearchesPerMinute int
+}
+
+var conf = new(ServerConf)
+
+// trustedProxies is conf.TrustedProxies parsed
+var trustedProxies []*net.IPNet
+
+func Load(loader *multiconfig.DefaultLoader) error {
+	conf = new(ServerConf)
+	loader.MustLoad(conf)
+
+	trustedProxies = nil
+	for _, p := range conf.TrustedProxies {
+		if !strings.Contains(p, "/") {
+			if ip := net.ParseIP(p); ip != nil && ip.To4() != nil {
+				p += "/32"
+			} else {
+				p += "/128"
+			}
+		}
+		_, n, err := net.ParseCIDR(p)
+		if err != nil {
+			return fmt.Errorf("TrustedProxies: %s", err)
+		}
+		trustedProxies = append(trustedProxies, n)
+	}
+
+	sched = newScheduler(conf.Scheduler)
+	return nil
+}
+
+func tenantConf(name string) TenantConf {
+	if name == "" {
+		name = tenant.Default
+	}
+	return conf.Tenant[name]
+}
@@ -0,0 +1,70 @@
+package controllers
+
+import (
+	"encoding/json"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/CheerChen/esalert/alert"
+	"github.com/CheerChen/esalert/events"
+	"github.com/CheerChen/esalert/redact"
+)
+
+func publish(typ string, a alert.Alert, data map[string]interface{}) {
+	events.Publish(events.Event{
+		Type:   typ,
+		JobId:  a.Name,
+		Tenant: a.Tenant,
+		UserId: a.UserId,
+		Data:   data,
+	})
+}
+
+type EventController struct{}
+
+// Stream pushes run lifecycle events as Server-Sent Events until the client
+// goes away. The optional job_id query parameter holds a comma separated list
+// of job ids to follow. Events never leave the caller's tenant, and non-admin
+// callers only receive events of their own jobs
+func (ctrl EventController) Stream(c *gin.Context) {
+	scope := currentScope(c)
+	ids := make(map[string]bool)
+	for _, id := range strings.Split(c.Query("job_id"), ",") {
+		if id = strings.TrimSpace(id); id != "" {
+			ids[id] = true
+		}
+	}
+
+	ch, unsubscribe := events.Subscribe(64)
+	defer unsubscribe()
+	ping := time.NewTicker(15 * time.Second)
+	defer ping.Stop()
+
+	c.Header("Cache-Control", "no-cache")
+	c.Header("X-Accel-Buffering", "no")
+	c.Stream(func(w io.Writer) bool {
+		select {
+		case e := <-ch:
+			if e.Tenant != scope.TenantId || (scope.UserId != "" && e.UserId != scope.UserId) {
+				return true
+			}
+			if len(ids) > 0 && !ids[e.JobId] {
+				return true
+			}
+			b, err := json.Marshal(e)
+			if err != nil {
+				return true
+			}
+			c.SSEvent(e.Type, string(redact.JSON(b)))
+			return true
+		case <-ping.C:
+			c.SSEvent("ping", time.Now().Unix())
+			return true
+		case <-c.Request.Context().Done():
+			return false
+		}
+	})
+}
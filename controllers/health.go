@@ -0,0 +1,164 @@
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/CheerChen/esalert/alert"
+	"github.com/CheerChen/esalert/models"
+	"github.com/CheerChen/esalert/redact"
+	"github.com/CheerChen/esalert/tenant"
+)
+
+type HealthController struct{}
+
+type componentStatus struct {
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+func newComponentStatus(err error) componentStatus {
+	if err != nil {
+		return componentStatus{Status: "fail", Error: err.Error()}
+	}
+	return componentStatus{Status: "ok"}
+}
+
+// Live only tells the process is up and serving http
+func (ctrl HealthController) Live(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{
+		"status": "ok",
+	})
+}
+
+// Ready checks the db, every configured cluster and every search_url used by
+// a running watcher, the scheduler heartbeat and the lua vm, and answers 503
+// if any of them fails. It is public, so it only tells the status of every
+// kind of component, Details has the rest
+func (ctrl HealthController) Ready(c *gin.Context) {
+	components, code := readiness(c)
+	kinds := make(map[string]componentStatus)
+	for name, st := range components {
+		kind := strings.SplitN(name, ":", 2)[0]
+		if prev, ok := kinds[kind]; !ok || prev.Status == "ok" {
+			kinds[kind] = componentStatus{Status: st.Status}
+		}
+	}
+	c.JSON(code, gin.H{
+		"status":     readyStatus(code),
+		"components": kinds,
+	})
+}
+
+// Details runs the checks of Ready and answers every cluster and search host
+// with its error, for admins
+func (ctrl HealthController) Details(c *gin.Context) {
+	components, code := readiness(c)
+	for name, st := range components {
+		st.Error = redact.String(st.Error)
+		components[name] = st
+	}
+	c.JSON(code, gin.H{
+		"status":     readyStatus(code),
+		"components": components,
+	})
+}
+
+func readyStatus(code int) string {
+	if code != http.StatusOK {
+		return "fail"
+	}
+	return "ok"
+}
+
+// readiness runs every check concurrently, components are keyed by
+// "<kind>" or "<kind>:<name>"
+func readiness(c *gin.Context) (map[string]componentStatus, int) {
+	ctx, cancel := context.WithTimeout(c.Request.Context(), 3*time.Second)
+	defer cancel()
+
+	components := make(map[string]componentStatus)
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	check := func(name string, fn func() error) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			st := newComponentStatus(fn())
+			mu.Lock()
+			components[name] = st
+			mu.Unlock()
+		}()
+	}
+
+	check("db", func() error {
+		return models.Ping(ctx)
+	})
+	for host, tenantId := range searchHosts() {
+		host, tenantId := host, tenantId
+		check("search:"+host, func() error {
+			return alert.PingSearch(tenant.NewContext(ctx, tenantId), host)
+		})
+	}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for name, err := range alert.PingClusters(ctx) {
+			mu.Lock()
+			components["cluster:"+name] = newComponentStatus(err)
+			mu.Unlock()
+		}
+	}()
+	check("scheduler", func() error {
+		if lag := time.Since(sched.heartbeat()); lag > 5*time.Second {
+			return fmt.Errorf("no heartbeat for %s", lag.Truncate(time.Second))
+		}
+		return nil
+	})
+	check("lua", func() error {
+		return alert.PingLua(2 * time.Second)
+	})
+	wg.Wait()
+
+	for _, st := range components {
+		if st.Status != "ok" {
+			return components, http.StatusServiceUnavailable
+		}
+	}
+	return components, http.StatusOK
+}
+
+// searchHosts returns the base url of every search cluster used by a running
+// watcher, along with a tenant whose credentials can reach it
+func searchHosts() map[string]string {
+	watchersMu.RLock()
+	jobs := make([]models.Job, 0, len(jobMap))
+	for _, job := range jobMap {
+		jobs = append(jobs, job)
+	}
+	watchersMu.RUnlock()
+
+	hosts := make(map[string]string)
+	for _, job := range jobs {
+		a, err := parseJob(job)
+		if err != nil {
+			continue
+		}
+		if a.SearchUrl == "" {
+			continue
+		}
+		u, err := url.Parse(a.SearchUrl)
+		if err != nil || u.Host == "" {
+			continue
+		}
+		hosts[u.Scheme+"://"+u.Host+"/"] = job.TenantId
+	}
+	return hosts
+}
@@ -1,8 +1,11 @@
 package controllers
 
 import (
+	"encoding/json"
+	"fmt"
 	"net/http"
 	"strconv"
+	"sync"
 	"time"
 
 	"github.com/gin-gonic/gin"
@@ -10,16 +13,27 @@ import (
 	"gopkg.in/yaml.v2"
 
 	"github.com/CheerChen/esalert/alert"
+	"github.com/CheerChen/esalert/events"
 	"github.com/CheerChen/esalert/models"
 	"github.com/CheerChen/esalert/logger"
+	"github.com/CheerChen/esalert/metrics"
+	"github.com/CheerChen/esalert/redact"
 )
 
 type JobController struct{}
 
+// watchersMu guards chMap and jobMap, which are used by the api handlers,
+// the watchers and the health checks at the same time
+var watchersMu sync.RWMutex
+
 var chMap map[string]chan int
 
+// job record of every running watcher, keyed like chMap
+var jobMap map[string]models.Job
+
 func init() {
 	chMap = make(map[string]chan int)
+	jobMap = make(map[string]models.Job)
 }
 
 func (ctrl JobController) Recover() {
@@ -33,15 +47,17 @@ func (ctrl JobController) Recover() {
 	)
 
 	for _, job := range jobs {
-		var a alert.Alert
-		if err := yaml.Unmarshal([]byte(job.Value), &a); err != nil {
+		a, err := parseJob(job)
+		if err != nil {
 			logger.Error("failed to parse yaml",
 				zap.Int64("id", job.Id),
 				zap.String("err", err.Error()),
 				zap.String("value", job.Value),
 			)
 		} else {
-			a.Name = strconv.FormatInt(job.Id, 10)
+			watchersMu.Lock()
+			jobMap[a.Name] = job
+			watchersMu.Unlock()
 			ctrl.initJob(a)
 		}
 	}
@@ -50,7 +66,7 @@ func (ctrl JobController) Recover() {
 // update job
 func (ctrl JobController) Trigger(c *gin.Context) {
 	id := c.Param("id")
-	job, err := models.GetJobById(id)
+	job, err := models.GetJobById(id, currentScope(c))
 	if err != nil {
 		c.JSON(http.StatusNotFound, gin.H{
 			"msg":   "job id not found",
@@ -59,47 +75,24 @@ func (ctrl JobController) Trigger(c *gin.Context) {
 		return
 	}
 
-	var a alert.Alert
-	if err := yaml.Unmarshal([]byte(job.Value), &a); err != nil {
-		logger.Error("failed to parse yaml",
-			zap.Int64("id", job.Id),
-			zap.String("err", err.Error()),
-			zap.String("value", job.Value),
-		)
+	msg, err := ctrl.sync(job)
+	if err != nil {
 		c.JSON(http.StatusNotAcceptable, gin.H{
-			"msg":   "failed to parse yaml",
+			"msg":   msg,
 			"error": err.Error(),
 		})
 		return
-	} else {
-		a.Name = strconv.FormatInt(job.Id, 10)
-
-		if job.Status == 1 && job.IsDeleted == 0 {
-			if _, ok := chMap[a.Name]; !ok {
-				ctrl.initJob(a)
-			} else {
-				go ctrl.reloadJob(a)
-			}
-			c.JSON(http.StatusOK, gin.H{
-				"msg": "reload ok",
-			})
-			return
-
-		} else {
-			go ctrl.stopJob(a)
-			c.JSON(http.StatusOK, gin.H{
-				"msg": "stop ok",
-			})
-			return
-		}
 	}
-
+	audit(c, AuditTrigger, job.Id, nil, job)
+	c.JSON(http.StatusOK, gin.H{
+		"msg": msg,
+	})
 }
 
 // force stop
 func (ctrl JobController) Stop(c *gin.Context) {
 	id := c.Param("id")
-	job, err := models.GetJobById(id)
+	job, err := models.GetJobById(id, currentScope(c))
 	if err != nil {
 		c.JSON(http.StatusNotFound, gin.H{
 			"msg":   "job id not found",
@@ -115,8 +108,9 @@ func (ctrl JobController) Stop(c *gin.Context) {
 		})
 		return
 	}
+	audit(c, AuditStop, job.Id, job, nil)
 	jobName := strconv.FormatInt(job.Id, 10)
-	if _, ok := chMap[jobName]; !ok {
+	if !watcherRunning(jobName) {
 		c.JSON(http.StatusNotFound, gin.H{
 			"msg": "job no running",
 		})
@@ -132,16 +126,421 @@ func (ctrl JobController) Stop(c *gin.Context) {
 }
 
 func (ctrl JobController) List(c *gin.Context) {
+	scope := currentScope(c)
+	watchersMu.RLock()
 	keys := make([]string, 0, len(chMap))
 	for k := range chMap {
+		if !scope.Covers(jobMap[k]) {
+			continue
+		}
 		keys = append(keys, k)
 	}
+	watchersMu.RUnlock()
 	c.JSON(http.StatusOK, gin.H{
 		"list": keys,
 	})
 	return
 }
 
+type jobForm struct {
+	Name   string `json:"name" binding:"required"`
+	Value  string `json:"value" binding:"required"`
+	Status int    `json:"status"`
+}
+
+type testForm struct {
+	Value string `json:"value" binding:"required"`
+}
+
+// Test checks a job definition without saving it, and returns the requests
+// it would send to elasticsearch right now, e.g. the query dsl compiled from
+// timeframe, filter, group_by and metric
+func (ctrl JobController) Test(c *gin.Context) {
+	var form testForm
+	if err := c.ShouldBindJSON(&form); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"msg":   "invalid job form",
+			"error": err.Error(),
+		})
+		return
+	}
+	token := currentToken(c)
+	a, err := parseJob(models.Job{
+		TenantId: token.TenantId,
+		UserId:   token.UserId,
+		Value:    form.Value,
+	})
+	if err != nil {
+		c.JSON(http.StatusNotAcceptable, gin.H{
+			"msg":   "failed to parse yaml",
+			"error": err.Error(),
+		})
+		return
+	}
+	if err := a.Init(); err != nil {
+		c.JSON(http.StatusNotAcceptable, gin.H{
+			"msg":   "invalid job",
+			"error": err.Error(),
+		})
+		return
+	}
+	query, searches, err := a.Queries(time.Now())
+	if err != nil {
+		c.JSON(http.StatusNotAcceptable, gin.H{
+			"msg":   "failed to render query",
+			"error": err.Error(),
+		})
+		return
+	}
+	violations, err := a.CheckPolicy(c.Request.Context(), time.Now())
+	if err != nil {
+		c.JSON(http.StatusNotAcceptable, gin.H{
+			"msg":   "failed to render query",
+			"error": err.Error(),
+		})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"input":      a.Source.Type,
+		"query":      query,
+		"searches":   searches,
+		"violations": violations,
+	})
+}
+
+// Get returns a single job definition
+func (ctrl JobController) Get(c *gin.Context) {
+	job, err := models.GetJobById(c.Param("id"), currentScope(c))
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{
+			"msg":   "job id not found",
+			"error": err.Error(),
+		})
+		return
+	}
+	c.JSON(http.StatusOK, job)
+}
+
+// Jobs returns every job definition visible to the caller
+func (ctrl JobController) Jobs(c *gin.Context) {
+	jobs, err := models.GetJobsByScope(currentScope(c))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"msg":   "failed to access db",
+			"error": err.Error(),
+		})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"list": jobs,
+	})
+}
+
+// Create saves a new job owned by the caller and starts it if enabled
+func (ctrl JobController) Create(c *gin.Context) {
+	var form jobForm
+	if err := c.ShouldBindJSON(&form); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"msg":   "invalid job form",
+			"error": err.Error(),
+		})
+		return
+	}
+	token := currentToken(c)
+	job := models.Job{
+		TenantId: token.TenantId,
+		UserId:   token.UserId,
+		Name:     form.Name,
+		Value:    form.Value,
+		Status:   form.Status,
+	}
+	if !checkJob(c, job, true) {
+		return
+	}
+
+	id, err := models.AddJob(job)
+	if err != nil {
+		c.JSON(http.StatusNotAcceptable, gin.H{
+			"msg":   "failed to save job",
+			"error": err.Error(),
+		})
+		return
+	}
+	job.Id = id
+	audit(c, AuditCreate, id, nil, job)
+
+	msg, err := ctrl.sync(job)
+	if err != nil {
+		c.JSON(http.StatusNotAcceptable, gin.H{
+			"msg":   msg,
+			"error": err.Error(),
+		})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"id":  id,
+		"msg": msg,
+	})
+}
+
+// Update replaces a job definition and reloads or stops its watcher
+func (ctrl JobController) Update(c *gin.Context) {
+	id := c.Param("id")
+	job, err := models.GetJobById(id, currentScope(c))
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{
+			"msg":   "job id not found",
+			"error": err.Error(),
+		})
+		return
+	}
+
+	var form jobForm
+	if err := c.ShouldBindJSON(&form); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"msg":   "invalid job form",
+			"error": err.Error(),
+		})
+		return
+	}
+	before := job
+	job.Name = form.Name
+	job.Value = form.Value
+	job.Status = form.Status
+	if !checkJob(c, job, false) {
+		return
+	}
+
+	if err := models.UpdateJobById(id, job); err != nil {
+		c.JSON(http.StatusNotAcceptable, gin.H{
+			"msg":   "failed to save job",
+			"error": err.Error(),
+		})
+		return
+	}
+	audit(c, AuditUpdate, job.Id, before, job)
+
+	msg, err := ctrl.sync(job)
+	if err != nil {
+		c.JSON(http.StatusNotAcceptable, gin.H{
+			"msg":   msg,
+			"error": err.Error(),
+		})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"msg": msg,
+	})
+}
+
+// Rollback restores the job definition recorded as "before" in an audit entry
+func (ctrl JobController) Rollback(c *gin.Context) {
+	id := c.Param("id")
+	job, err := models.GetJobById(id, currentScope(c))
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{
+			"msg":   "job id not found",
+			"error": err.Error(),
+		})
+		return
+	}
+	entry, err := models.GetAuditById(c.Param("audit_id"), job.TenantId)
+	if err != nil || entry.JobId != job.Id || entry.Before == "" {
+		c.JSON(http.StatusNotFound, gin.H{
+			"msg": "no previous version in audit entry",
+		})
+		return
+	}
+
+	var prev models.Job
+	if err := json.Unmarshal([]byte(entry.Before), &prev); err != nil {
+		c.JSON(http.StatusNotAcceptable, gin.H{
+			"msg":   "failed to parse audit payload",
+			"error": err.Error(),
+		})
+		return
+	}
+	before := job
+	job.Name = prev.Name
+	job.Value = prev.Value
+	job.Status = prev.Status
+	if !checkJob(c, job, false) {
+		return
+	}
+	if err := models.UpdateJobById(id, job); err != nil {
+		c.JSON(http.StatusNotAcceptable, gin.H{
+			"msg":   "failed to save job",
+			"error": err.Error(),
+		})
+		return
+	}
+	audit(c, AuditRollback, job.Id, before, job)
+
+	msg, err := ctrl.sync(job)
+	if err != nil {
+		c.JSON(http.StatusNotAcceptable, gin.H{
+			"msg":   msg,
+			"error": err.Error(),
+		})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"msg": msg,
+	})
+}
+
+func parseJob(job models.Job) (alert.Alert, error) {
+	var a alert.Alert
+	if err := yaml.Unmarshal([]byte(job.Value), &a); err != nil {
+		return a, err
+	}
+	a.Name = strconv.FormatInt(job.Id, 10)
+	a.Tenant = job.TenantId
+	a.UserId = job.UserId
+	return a, nil
+}
+
+// checkJob runs the save time checks of a job, parsing, tenant quota and
+// query policy, and answers the request when one of them fails
+func checkJob(c *gin.Context, job models.Job, creating bool) bool {
+	if _, err := parseJob(job); err != nil {
+		c.JSON(http.StatusNotAcceptable, gin.H{
+			"msg":   "failed to parse yaml",
+			"error": err.Error(),
+		})
+		return false
+	}
+	if msg, err := checkQuota(job, creating); err != nil {
+		c.JSON(http.StatusForbidden, gin.H{
+			"msg":   msg,
+			"error": err.Error(),
+		})
+		return false
+	}
+	violations, msg, err := checkPolicy(c, job)
+	if err != nil {
+		c.JSON(http.StatusNotAcceptable, gin.H{
+			"msg":   msg,
+			"error": err.Error(),
+		})
+		return false
+	}
+	if len(violations) > 0 {
+		c.JSON(http.StatusNotAcceptable, gin.H{
+			"msg":        "query policy violated",
+			"error":      violations[0].String(),
+			"violations": violations,
+		})
+		return false
+	}
+	return true
+}
+
+// checkPolicy checks the searches of a job against the query policy, a job
+// which cannot be initialized cannot be checked and is rejected
+func checkPolicy(c *gin.Context, job models.Job) ([]alert.Violation, string, error) {
+	a, err := parseJob(job)
+	if err != nil {
+		return nil, "failed to parse yaml", err
+	}
+	if err := a.Init(); err != nil {
+		return nil, "invalid job", err
+	}
+	violations, err := a.CheckPolicy(c.Request.Context(), time.Now())
+	if err != nil {
+		return nil, "failed to render query", err
+	}
+	return violations, "", nil
+}
+
+// checkQuota enforces the save time limits of the job's tenant, the job
+// count is only checked for new jobs
+func checkQuota(job models.Job, creating bool) (string, error) {
+	tc := tenantConf(job.TenantId)
+	if creating && tc.MaxJobs > 0 {
+		count, err := models.CountJobs(models.Scope{TenantId: job.TenantId})
+		if err != nil {
+			return "failed to access db", err
+		}
+		if count >= tc.MaxJobs {
+			return "job quota exceeded", fmt.Errorf("tenant %s already has %d of %d jobs", job.TenantId, count, tc.MaxJobs)
+		}
+	}
+	if creating && tc.UserMaxJobs > 0 {
+		count, err := models.CountJobs(models.Scope{TenantId: job.TenantId, UserId: job.UserId})
+		if err != nil {
+			return "failed to access db", err
+		}
+		if count >= tc.UserMaxJobs {
+			return "job quota exceeded", fmt.Errorf("user %s already has %d of %d jobs in tenant %s", job.UserId, count, tc.UserMaxJobs, job.TenantId)
+		}
+	}
+
+	if tc.MinInterval > 0 {
+		a, err := parseJob(job)
+		if err != nil {
+			return "failed to parse yaml", err
+		}
+		if err := a.Init(); err != nil {
+			return "failed to initialize alert", err
+		}
+		min := time.Duration(tc.MinInterval) * time.Second
+		if gap := a.Timer.MinInterval(time.Now(), 7*24*time.Hour); gap > 0 && gap < min {
+			return "interval quota exceeded", fmt.Errorf("job fires every %s, tenant %s allows at most once every %s", gap, job.TenantId, min)
+		}
+	}
+	return "", nil
+}
+
+// sync brings the watcher of a job in line with its stored definition
+func (ctrl JobController) sync(job models.Job) (string, error) {
+	a, err := parseJob(job)
+	if err != nil {
+		logger.Error("failed to parse yaml",
+			zap.Int64("id", job.Id),
+			zap.String("err", err.Error()),
+			zap.String("value", job.Value),
+		)
+		return "failed to parse yaml", err
+	}
+
+	if job.Status == 1 && job.IsDeleted == 0 {
+		watchersMu.Lock()
+		jobMap[a.Name] = job
+		_, running := chMap[a.Name]
+		watchersMu.Unlock()
+		if !running {
+			ctrl.initJob(a)
+		} else {
+			go ctrl.reloadJob(a)
+		}
+		return "reload ok", nil
+	}
+
+	if watcherRunning(a.Name) {
+		go ctrl.stopJob(a)
+	}
+	return "stop ok", nil
+}
+
+// watcherRunning tells whether the job named name has a running watcher
+func watcherRunning(name string) bool {
+	watchersMu.RLock()
+	defer watchersMu.RUnlock()
+	_, ok := chMap[name]
+	return ok
+}
+
+// startWatcher registers the quit channel of a new watcher of a
+func (ctrl JobController) startWatcher(a alert.Alert) {
+	quit := make(chan int)
+	watchersMu.Lock()
+	chMap[a.Name] = quit
+	metrics.Watchers.Set(float64(len(chMap)))
+	watchersMu.Unlock()
+	go ctrl.jobSpin(a, quit)
+}
+
 func (ctrl JobController) initJob(a alert.Alert) {
 	if err := a.Init(); err != nil {
 		logger.Error("failed to initialize alert",
@@ -149,8 +548,8 @@ func (ctrl JobController) initJob(a alert.Alert) {
 			zap.String("err", err.Error()),
 		)
 	} else {
-		chMap[a.Name] = make(chan int)
-		go ctrl.jobSpin(a)
+		ctrl.startWatcher(a)
+		publish(events.JobStarted, a, nil)
 		logger.Info("initialized alert",
 			zap.String("id", a.Name),
 		)
@@ -158,7 +557,13 @@ func (ctrl JobController) initJob(a alert.Alert) {
 }
 
 func (ctrl JobController) reloadJob(a alert.Alert) {
+	watchersMu.RLock()
+	job := jobMap[a.Name]
+	watchersMu.RUnlock()
 	ctrl.stopJob(a)
+	watchersMu.Lock()
+	jobMap[a.Name] = job
+	watchersMu.Unlock()
 
 	if err := a.Init(); err != nil {
 		logger.Error("failed to initialize alert",
@@ -166,8 +571,8 @@ func (ctrl JobController) reloadJob(a alert.Alert) {
 			zap.String("err", err.Error()),
 		)
 	} else {
-		chMap[a.Name] = make(chan int)
-		go ctrl.jobSpin(a)
+		ctrl.startWatcher(a)
+		publish(events.JobReloaded, a, nil)
 		logger.Info("reloaded alert",
 			zap.String("id", a.Name),
 		)
@@ -179,18 +584,41 @@ func (ctrl JobController) stopJob(a alert.Alert) {
 		zap.String("id", a.Name),
 	)
 
-	close(chMap[a.Name])
-	time.Sleep(time.Second)
+	watchersMu.Lock()
+	if job, ok := jobMap[a.Name]; ok {
+		a.Tenant = job.TenantId
+		a.UserId = job.UserId
+	}
+	quit, ok := chMap[a.Name]
+	if !ok {
+		watchersMu.Unlock()
+		return
+	}
+	close(quit)
 	delete(chMap, a.Name)
+	metrics.Watchers.Set(float64(len(chMap)))
+	watchersMu.Unlock()
+
+	publish(events.JobStopped, a, nil)
+	time.Sleep(time.Second)
+	watchersMu.Lock()
+	_, restarted := chMap[a.Name]
+	if !restarted {
+		delete(jobMap, a.Name)
+	}
+	watchersMu.Unlock()
+	if !restarted && sched != nil {
+		sched.forget(a.Name)
+	}
 	logger.Info("removed from alert channel map",
 		zap.String("id", a.Name),
 	)
 }
 
-func (ctrl JobController) jobSpin(a alert.Alert) {
+func (ctrl JobController) jobSpin(a alert.Alert, quit chan int) {
 	for {
 		select {
-		case <-chMap[a.Name]:
+		case <-quit:
 			logger.Info("received quit sign, return", zap.String("id", a.Name))
 			return
 		default:
@@ -198,9 +626,66 @@ func (ctrl JobController) jobSpin(a alert.Alert) {
 			next := a.Timer.Next(now)
 			if now == next {
 				logger.Info("start alert spin", zap.String("id", a.Name))
-				go a.Run()
+				sched.submit(a, next)
 			}
 			time.Sleep(time.Second)
 		}
 	}
 }
+
+func saveRun(a alert.Alert, rec alert.Record) {
+	metrics.Runs.WithLabelValues(a.Name, a.Tenant, rec.Status).Inc()
+
+	jobId, _ := strconv.ParseInt(a.Name, 10, 64)
+	err := models.AddRun(models.Run{
+		TenantId:   a.Tenant,
+		JobId:      jobId,
+		Status:     rec.Status,
+		Step:       rec.Step,
+		Hits:       rec.Hits,
+		Actions:    rec.Actions,
+		Error:      redact.String(rec.Error),
+		ErrorType:  rec.ErrorType,
+		StartedAt:  rec.StartedAt.Format("2006-01-02 15:04:05"),
+		DurationMS: int64(rec.Duration / time.Millisecond),
+		TraceId:    rec.TraceId,
+
+		ShardsTotal:  rec.Shards.Total,
+		ShardsFailed: rec.Shards.Failed,
+		Cache:        rec.Cache,
+	})
+	if err != nil {
+		logger.Error("failed to write run history",
+			zap.String("id", a.Name),
+			zap.String("err", err.Error()),
+		)
+	}
+}
+
+// Runs returns the latest run history of a job, at most "limit" entries
+func (ctrl JobController) Runs(c *gin.Context) {
+	job, err := models.GetJobById(c.Param("id"), currentScope(c))
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{
+			"msg":   "job id not found",
+			"error": err.Error(),
+		})
+		return
+	}
+	limit := 20
+	if l, err := strconv.Atoi(c.Query("limit")); err == nil && l > 0 && l <= 1000 {
+		limit = l
+	}
+
+	runs, err := models.GetRunsByJobId(job.Id, job.TenantId, limit)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"msg":   "failed to access db",
+			"error": err.Error(),
+		})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"list": runs,
+	})
+}
@@ -0,0 +1,268 @@
+package controllers
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/CheerChen/esalert/alert"
+	"github.com/CheerChen/esalert/events"
+	"github.com/CheerChen/esalert/logger"
+	"github.com/CheerChen/esalert/metrics"
+	"github.com/CheerChen/esalert/tenant"
+)
+
+// StatusRejected marks a run the scheduler refused to start
+const StatusRejected = "rejected"
+
+type task struct {
+	a       alert.Alert
+	planned time.Time
+}
+
+// scheduler runs due alerts on a fixed pool of workers. Every tenant has its
+// own queue, and idle workers pick from the queues round-robin, so a tenant
+// with many heavy alerts cannot starve the others when the pool is saturated
+type scheduler struct {
+	conf SchedulerConf
+
+	mu      sync.Mutex
+	cond    *sync.Cond
+	queues  map[string][]task
+	order   []string // tenants in round-robin order
+	next    int      // index into order of the tenant to serve next
+	running map[string]int         // by tenant and by user, see userKey
+	started map[string][]time.Time // send times of the searches within the last minute, same keys
+	last    map[string]time.Time   // planned time of the last run by job
+
+	beat int64 // unix time of the last tick, read atomically
+}
+
+var sched *scheduler
+
+func newScheduler(sc SchedulerConf) *scheduler {
+	s := &scheduler{
+		conf:    sc,
+		queues:  make(map[string][]task),
+		running: make(map[string]int),
+		started: make(map[string][]time.Time),
+		last:    make(map[string]time.Time),
+	}
+	s.cond = sync.NewCond(&s.mu)
+	for i := 0; i < sc.Workers; i++ {
+		go s.work()
+	}
+	go s.tick()
+	return s
+}
+
+// submit queues a due run of the alert, planned is the fire time computed
+// from its interval
+func (s *scheduler) submit(a alert.Alert, planned time.Time) {
+	name := a.Tenant
+	if name == "" {
+		name = tenant.Default
+	}
+
+	s.mu.Lock()
+	// MinInterval is checked when a job is saved, this catches the gaps
+	// of irregular schedules the check missed
+	if min := time.Duration(tenantConf(name).MinInterval) * time.Second; min > 0 {
+		if last, ok := s.last[a.Name]; ok && planned.Sub(last) < min {
+			s.mu.Unlock()
+			reject(a, planned, fmt.Sprintf("fires %s after its last run, tenant %s allows at most once every %s", planned.Sub(last), name, min))
+			return
+		}
+	}
+	if len(s.queues[name]) >= s.conf.MaxQueue {
+		s.mu.Unlock()
+		reject(a, planned, fmt.Sprintf("tenant %s has %d runs queued", name, s.conf.MaxQueue))
+		return
+	}
+	if _, ok := s.queues[name]; !ok {
+		s.order = append(s.order, name)
+	}
+	s.queues[name] = append(s.queues[name], task{a: a, planned: planned})
+	s.last[a.Name] = planned
+	s.mu.Unlock()
+	s.cond.Signal()
+
+	publish(events.Scheduled, a, map[string]interface{}{
+		"planned": planned,
+	})
+}
+
+// forget drops the last run of a job which stopped
+func (s *scheduler) forget(job string) {
+	s.mu.Lock()
+	delete(s.last, job)
+	s.mu.Unlock()
+}
+
+// tick wakes idle workers every second, so runs held back by
+// SearchesPerMinute get picked up once the window moves on
+func (s *scheduler) tick() {
+	for now := range time.Tick(time.Second) {
+		atomic.StoreInt64(&s.beat, now.Unix())
+		s.expire()
+		s.cond.Broadcast()
+	}
+}
+
+// heartbeat returns the time of the last tick
+func (s *scheduler) heartbeat() time.Time {
+	return time.Unix(atomic.LoadInt64(&s.beat), 0)
+}
+
+// expire rejects runs which stayed queued longer than MaxWait
+func (s *scheduler) expire() {
+	deadline := time.Now().Add(-time.Duration(s.conf.MaxWait) * time.Second)
+	var expired []task
+
+	s.mu.Lock()
+	for name, q := range s.queues {
+		i := 0
+		for i < len(q) && q[i].planned.Before(deadline) {
+			i++
+		}
+		expired = append(expired, q[:i]...)
+		s.queues[name] = q[i:]
+	}
+	s.mu.Unlock()
+
+	for _, t := range expired {
+		reject(t.a, t.planned, fmt.Sprintf("queued for more than %ds", s.conf.MaxWait))
+	}
+}
+
+func (s *scheduler) work() {
+	for {
+		s.mu.Lock()
+		t, name, ok := s.pick()
+		for !ok {
+			s.cond.Wait()
+			t, name, ok = s.pick()
+		}
+		// every input sends at least one search, once the run tells how
+		// many it sent the unused reservations are given back and pages
+		// and the like added
+		reserved, at := t.a.InputCount(), time.Now()
+		keys := []string{name, userKey(name, t.a.UserId)}
+		for _, key := range keys {
+			s.running[key]++
+			s.started[key] = appendTimes(s.started[key], at, reserved)
+		}
+		s.mu.Unlock()
+
+		metrics.SchedulerLag.Observe(time.Since(t.planned).Seconds())
+		rec := t.a.Run()
+		saveRun(t.a, rec)
+
+		s.mu.Lock()
+		for _, key := range keys {
+			if s.running[key]--; s.running[key] == 0 {
+				delete(s.running, key)
+			}
+			if rec.Searches < reserved {
+				s.started[key] = removeTimes(s.started[key], at, reserved-rec.Searches)
+			} else {
+				s.started[key] = appendTimes(s.started[key], time.Now(), rec.Searches-reserved)
+			}
+		}
+		s.mu.Unlock()
+		s.cond.Signal()
+	}
+}
+
+// pick pops the oldest task, of the next tenant in round-robin order, which
+// is within the limits of its tenant and user. It must be called with mu held
+func (s *scheduler) pick() (task, string, bool) {
+	now := time.Now()
+	for i := 0; i < len(s.order); i++ {
+		name := s.order[(s.next+i)%len(s.order)]
+		q := s.queues[name]
+		tc := tenantConf(name)
+		if len(q) == 0 || !s.within(name, tc.MaxConcurrent, tc.SearchesPerMinute, now) {
+			continue
+		}
+
+		// the runs of a user over their limits wait, the other users of
+		// the tenant go first
+		for j, t := range q {
+			if !s.within(userKey(name, t.a.UserId), tc.UserMaxConcurrent, tc.UserSearchesPerMinute, now) {
+				continue
+			}
+			s.queues[name] = append(q[:j:j], q[j+1:]...)
+			s.next = (s.next + i + 1) % len(s.order)
+			return t, name, true
+		}
+	}
+	return task{}, "", false
+}
+
+// within tells whether the runs of key are below maxConcurrent and the
+// searches they sent in the last minute below perMinute, zero is unlimited.
+// It must be called with mu held
+func (s *scheduler) within(key string, maxConcurrent, perMinute int, now time.Time) bool {
+	if maxConcurrent > 0 && s.running[key] >= maxConcurrent {
+		return false
+	}
+	started := s.started[key]
+	for len(started) > 0 && now.Sub(started[0]) >= time.Minute {
+		started = started[1:]
+	}
+	if len(started) == 0 {
+		delete(s.started, key)
+	} else {
+		s.started[key] = started
+	}
+	return perMinute == 0 || len(started) < perMinute
+}
+
+// userKey keys the counters of a user of a tenant
+func userKey(tenantName, userId string) string {
+	return tenantName + "/" + userId
+}
+
+// appendTimes appends n times t to times, which stays sorted as long as t
+// is not before its last time
+func appendTimes(times []time.Time, t time.Time, n int) []time.Time {
+	for i := 0; i < n; i++ {
+		times = append(times, t)
+	}
+	return times
+}
+
+// removeTimes removes up to n times equal to t from times, fewer when some
+// already left the window
+func removeTimes(times []time.Time, t time.Time, n int) []time.Time {
+	out := times[:0]
+	for _, at := range times {
+		if n > 0 && at.Equal(t) {
+			n--
+			continue
+		}
+		out = append(out, at)
+	}
+	return out
+}
+
+func reject(a alert.Alert, planned time.Time, reason string) {
+	logger.Warn("rejected alert run",
+		zap.String("id", a.Name),
+		zap.String("tenant", a.Tenant),
+		zap.String("reason", reason),
+	)
+	publish(events.Rejected, a, map[string]interface{}{
+		"reason": reason,
+	})
+	saveRun(a, alert.Record{
+		StartedAt: planned,
+		Status:    StatusRejected,
+		Step:      "schedule",
+		Error:     "rejected by scheduler: " + reason,
+	})
+}
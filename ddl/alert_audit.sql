@@ -0,0 +1,16 @@
+CREATE TABLE `alert_audit` (
+  `id` int(11) NOT NULL AUTO_INCREMENT COMMENT 'PK',
+  `tenant_id` varchar(30) COLLATE utf8mb4_unicode_ci NOT NULL DEFAULT 'default' COMMENT 'tenant_id',
+  `user_id` varchar(11) COLLATE utf8mb4_unicode_ci NOT NULL DEFAULT '0' COMMENT 'user_id',
+  `job_id` int(11) NOT NULL DEFAULT '0' COMMENT 'alert_job.id',
+  `action` varchar(20) COLLATE utf8mb4_unicode_ci NOT NULL DEFAULT '' COMMENT 'create/update/trigger/stop/rollback',
+  `ip` varchar(45) COLLATE utf8mb4_unicode_ci NOT NULL DEFAULT '' COMMENT 'client ip',
+  `before` text COLLATE utf8mb4_unicode_ci NOT NULL COMMENT 'json payload before',
+  `after` text COLLATE utf8mb4_unicode_ci NOT NULL COMMENT 'json payload after',
+  `created_at` timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP COMMENT 'created_at',
+  PRIMARY KEY (`id`) USING BTREE,
+  KEY `job_id` (`job_id`) USING BTREE,
+  KEY `tenant_id` (`tenant_id`) USING BTREE,
+  KEY `user_id` (`user_id`) USING BTREE,
+  KEY `created_at` (`created_at`) USING BTREE
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci ROW_FORMAT=COMPACT;
@@ -1,5 +1,6 @@
 CREATE TABLE `alert_job` (
   `id` int(11) NOT NULL AUTO_INCREMENT COMMENT 'PK',
+  `tenant_id` varchar(30) COLLATE utf8mb4_unicode_ci NOT NULL DEFAULT 'default' COMMENT 'tenant_id',
   `user_id` varchar(11) COLLATE utf8mb4_unicode_ci NOT NULL DEFAULT '0' COMMENT 'user_id',
   `name` varchar(30) COLLATE utf8mb4_unicode_ci NOT NULL DEFAULT '' COMMENT 'name',
   `value` text COLLATE utf8mb4_unicode_ci NOT NULL COMMENT 'yaml',
@@ -8,5 +9,6 @@ CREATE TABLE `alert_job` (
   `created_at` timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP COMMENT 'created_at',
   `updated_at` timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP COMMENT 'updated_at',
   PRIMARY KEY (`id`) USING BTREE,
+  KEY `tenant_id` (`tenant_id`) USING BTREE,
   KEY `user_id` (`user_id`) USING BTREE
 ) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci ROW_FORMAT=COMPACT;
\ No newline at end of file
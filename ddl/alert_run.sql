@@ -0,0 +1,19 @@
+CREATE TABLE `alert_run` (
+  `id` bigint(20) NOT NULL AUTO_INCREMENT COMMENT 'PK',
+  `tenant_id` varchar(30) COLLATE utf8mb4_unicode_ci NOT NULL DEFAULT 'default' COMMENT 'tenant_id',
+  `job_id` int(11) NOT NULL DEFAULT '0' COMMENT 'alert_job.id',
+  `status` varchar(10) COLLATE utf8mb4_unicode_ci NOT NULL DEFAULT '' COMMENT 'ok/no_action/failed/rejected',
+  `step` varchar(10) COLLATE utf8mb4_unicode_ci NOT NULL DEFAULT '' COMMENT 'last step reached',
+  `hits` bigint(20) NOT NULL DEFAULT '0' COMMENT 'hits.total',
+  `actions` int(11) NOT NULL DEFAULT '0' COMMENT 'actions sent',
+  `error` text COLLATE utf8mb4_unicode_ci NOT NULL COMMENT 'error',
+  `error_type` varchar(100) COLLATE utf8mb4_unicode_ci NOT NULL DEFAULT '' COMMENT 'elasticsearch error.type or partial_results',
+  `shards_total` int(11) NOT NULL DEFAULT '0' COMMENT '_shards.total',
+  `shards_failed` int(11) NOT NULL DEFAULT '0' COMMENT '_shards.failed',
+  `cache` varchar(4) COLLATE utf8mb4_unicode_ci NOT NULL DEFAULT '' COMMENT 'hit/miss, empty when not cached',
+  `started_at` timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP COMMENT 'started_at',
+  `duration_ms` int(11) NOT NULL DEFAULT '0' COMMENT 'duration_ms',
+  `trace_id` char(32) COLLATE utf8mb4_unicode_ci NOT NULL DEFAULT '' COMMENT 'opentelemetry trace id',
+  PRIMARY KEY (`id`) USING BTREE,
+  KEY `tenant_job` (`tenant_id`,`job_id`) USING BTREE
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci ROW_FORMAT=COMPACT;
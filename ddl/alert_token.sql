@@ -0,0 +1,15 @@
+CREATE TABLE `alert_token` (
+  `id` int(11) NOT NULL AUTO_INCREMENT COMMENT 'PK',
+  `tenant_id` varchar(30) COLLATE utf8mb4_unicode_ci NOT NULL DEFAULT 'default' COMMENT 'tenant_id',
+  `user_id` varchar(11) COLLATE utf8mb4_unicode_ci NOT NULL DEFAULT '0' COMMENT 'user_id',
+  `name` varchar(30) COLLATE utf8mb4_unicode_ci NOT NULL DEFAULT '' COMMENT 'name',
+  `role` varchar(10) COLLATE utf8mb4_unicode_ci NOT NULL DEFAULT 'viewer' COMMENT 'viewer/owner/admin',
+  `token_hash` char(64) COLLATE utf8mb4_unicode_ci NOT NULL DEFAULT '' COMMENT 'sha256 hex of token',
+  `is_deleted` tinyint(4) NOT NULL DEFAULT '0' COMMENT 'is_deleted',
+  `created_at` timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP COMMENT 'created_at',
+  `updated_at` timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP COMMENT 'updated_at',
+  PRIMARY KEY (`id`) USING BTREE,
+  UNIQUE KEY `token_hash` (`token_hash`) USING BTREE,
+  KEY `tenant_id` (`tenant_id`) USING BTREE,
+  KEY `user_id` (`user_id`) USING BTREE
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci ROW_FORMAT=COMPACT;
@@ -0,0 +1 @@
+ALTER TABLE `alert_run` ADD COLUMN `cache` varchar(4) COLLATE utf8mb4_unicode_ci NOT NULL DEFAULT '' COMMENT 'hit/miss, empty when not cached' AFTER `shards_failed`;
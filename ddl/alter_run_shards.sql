@@ -0,0 +1 @@
+ALTER TABLE `alert_run` ADD COLUMN `error_type` varchar(100) COLLATE utf8mb4_unicode_ci NOT NULL DEFAULT '' COMMENT 'elasticsearch error.type or partial_results' AFTER `error`, ADD COLUMN `shards_total` int(11) NOT NULL DEFAULT '0' COMMENT '_shards.total' AFTER `error_type`, ADD COLUMN `shards_failed` int(11) NOT NULL DEFAULT '0' COMMENT '_shards.failed' AFTER `shards_total`;
@@ -0,0 +1,3 @@
+ALTER TABLE `alert_job` ADD COLUMN `tenant_id` varchar(30) COLLATE utf8mb4_unicode_ci NOT NULL DEFAULT 'default' COMMENT 'tenant_id' AFTER `id`, ADD KEY `tenant_id` (`tenant_id`);
+ALTER TABLE `alert_token` ADD COLUMN `tenant_id` varchar(30) COLLATE utf8mb4_unicode_ci NOT NULL DEFAULT 'default' COMMENT 'tenant_id' AFTER `id`, ADD KEY `tenant_id` (`tenant_id`);
+ALTER TABLE `alert_audit` ADD COLUMN `tenant_id` varchar(30) COLLATE utf8mb4_unicode_ci NOT NULL DEFAULT 'default' COMMENT 'tenant_id' AFTER `id`, ADD KEY `tenant_id` (`tenant_id`);
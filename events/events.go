@@ -0,0 +1,72 @@
+// 运行事件：告警流水线的生命周期事件，供 /events 实时推送
+package events
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	Scheduled    = "scheduled"     // a due run was queued
+	Rejected     = "rejected"      // the scheduler refused a run
+	SearchDone   = "search_done"   // the search step finished, data.error is set on failure
+	LuaResult    = "lua_result"    // the process step finished
+	ActionSent   = "action_sent"   // an action succeeded
+	ActionFailed = "action_failed" // an action failed
+	RunFinished  = "run_finished"  // a run ended, data.status holds the outcome
+	JobStarted   = "job_started"   // a watcher was started
+	JobReloaded  = "job_reloaded"  // a watcher was restarted with a new definition
+	JobStopped   = "job_stopped"   // a watcher was stopped
+)
+
+type Event struct {
+	Type   string                 `json:"type"`
+	JobId  string                 `json:"job_id"`
+	Tenant string                 `json:"tenant"`
+	UserId string                 `json:"user_id"`
+	Time   time.Time              `json:"time"`
+	Data   map[string]interface{} `json:"data,omitempty"`
+}
+
+type subscriber struct {
+	ch chan Event
+}
+
+var (
+	mu   sync.RWMutex
+	subs = make(map[*subscriber]struct{})
+)
+
+// Publish hands e to every subscriber. It never blocks, subscribers which
+// fall behind miss events
+func Publish(e Event) {
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+	mu.RLock()
+	defer mu.RUnlock()
+	for s := range subs {
+		select {
+		case s.ch <- e:
+		default:
+		}
+	}
+}
+
+// Subscribe returns a channel receiving every published event, and a
+// function which must be called once the channel is no longer read
+func Subscribe(buffer int) (<-chan Event, func()) {
+	s := &subscriber{ch: make(chan Event, buffer)}
+	mu.Lock()
+	subs[s] = struct{}{}
+	mu.Unlock()
+
+	var once sync.Once
+	return s.ch, func() {
+		once.Do(func() {
+			mu.Lock()
+			delete(subs, s)
+			mu.Unlock()
+		})
+	}
+}
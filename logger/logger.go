@@ -1,25 +1,232 @@
 package logger
 
 import (
+	"os"
 	"sync"
+	"time"
 
+	"github.com/koding/multiconfig"
 	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"gopkg.in/natefinch/lumberjack.v2"
+
+	"github.com/CheerChen/esalert/redact"
 )
 
 var singleton *zap.Logger
 var once sync.Once
+var verbose bool
+
+// stopRotate stops the RotateInterval timer of the logger built by the
+// last Load
+var stopRotate func()
+
+type ServerConf struct {
+	Log LogConf
+}
+
+type LogConf struct {
+	Level    string `default:"info"` // debug, info, warn or error
+	Encoding string `default:"json"` // json or console
+	File     string `default:""`     // empty logs to stderr
+
+	MaxSize        int    `default:"100"` // megabytes before the file is rotated
+	MaxAge         int    `default:"7"`   // days rotated files are kept
+	MaxBackups     int    `default:"10"`  // rotated files kept
+	RotateInterval string `default:""`    // also rotate on a timer, e.g. "24h"
+
+	SamplingInitial    int `default:"100"` // entries per second logged for each message, 0 disables sampling
+	SamplingThereafter int `default:"100"` // then only every Nth
+
+	Verbose   bool     `default:"false"` // log full search requests and responses
+	DebugJobs []string // job ids logged at debug level regardless of Level
+}
 
 // Init initializes a thread-safe singleton logger
 // This would be called from a main method when the application starts up
-// This function would ideally, take zap configuration, but is left out
-// in favor of simplicity using the example logger.
+// It uses the example production logger until Load replaces it with the
+// configured one.
 func init() {
 	// once ensures the singleton is initialized only once
 	once.Do(func() {
-		singleton, _ = zap.NewProduction()
+		singleton, _ = zap.NewProduction(zap.WrapCore(func(core zapcore.Core) zapcore.Core {
+			return redactCore{core}
+		}))
 	})
 }
 
+// Load replaces the singleton logger with one built from the [Log] section
+func Load(loader *multiconfig.DefaultLoader) error {
+	conf := new(ServerConf)
+	loader.MustLoad(conf)
+
+	var level zapcore.Level
+	if err := level.UnmarshalText([]byte(conf.Log.Level)); err != nil {
+		return err
+	}
+
+	encCfg := zap.NewProductionEncoderConfig()
+	encCfg.EncodeTime = zapcore.ISO8601TimeEncoder
+	var enc zapcore.Encoder
+	if conf.Log.Encoding == "console" {
+		enc = zapcore.NewConsoleEncoder(encCfg)
+	} else {
+		enc = zapcore.NewJSONEncoder(encCfg)
+	}
+
+	var rotate time.Duration
+	if conf.Log.RotateInterval != "" {
+		var err error
+		if rotate, err = time.ParseDuration(conf.Log.RotateInterval); err != nil {
+			return err
+		}
+	}
+
+	if stopRotate != nil {
+		stopRotate()
+		stopRotate = nil
+	}
+	out := zapcore.Lock(os.Stderr)
+	if conf.Log.File != "" {
+		lj := &lumberjack.Logger{
+			Filename:   conf.Log.File,
+			MaxSize:    conf.Log.MaxSize,
+			MaxAge:     conf.Log.MaxAge,
+			MaxBackups: conf.Log.MaxBackups,
+		}
+		if rotate > 0 {
+			ticker := time.NewTicker(rotate)
+			done := make(chan struct{})
+			go func() {
+				for {
+					select {
+					case <-ticker.C:
+						lj.Rotate()
+					case <-done:
+						return
+					}
+				}
+			}()
+			stopRotate = func() {
+				ticker.Stop()
+				close(done)
+			}
+		}
+		out = zapcore.AddSync(lj)
+	}
+
+	var core zapcore.Core
+	if len(conf.Log.DebugJobs) > 0 {
+		jobs := make(map[string]bool, len(conf.Log.DebugJobs))
+		for _, id := range conf.Log.DebugJobs {
+			jobs[id] = true
+		}
+		core = jobCore{
+			Core: zapcore.NewCore(enc, out, zapcore.DebugLevel),
+			base: level,
+			jobs: jobs,
+		}
+	} else {
+		core = zapcore.NewCore(enc, out, level)
+	}
+	core = redactCore{core}
+	if conf.Log.SamplingInitial > 0 {
+		core = zapcore.NewSampler(core, time.Second, conf.Log.SamplingInitial, conf.Log.SamplingThereafter)
+	}
+
+	singleton = zap.New(core, zap.AddCaller(), zap.AddCallerSkip(1), zap.AddStacktrace(zapcore.ErrorLevel))
+	verbose = conf.Log.Verbose
+	return nil
+}
+
+// Verbose tells whether full request and response payloads should be logged
+func Verbose() bool {
+	return verbose
+}
+
+// jobCore lets entries below the configured level through when they carry
+// the "id" of one of the debug jobs
+type jobCore struct {
+	zapcore.Core
+	base    zapcore.Level
+	jobs    map[string]bool
+	matched bool
+}
+
+func (c jobCore) matches(fields []zapcore.Field) bool {
+	for _, f := range fields {
+		if f.Key == "id" && f.Type == zapcore.StringType && c.jobs[f.String] {
+			return true
+		}
+	}
+	return false
+}
+
+func (c jobCore) With(fields []zapcore.Field) zapcore.Core {
+	return jobCore{
+		Core:    c.Core.With(fields),
+		base:    c.base,
+		jobs:    c.jobs,
+		matched: c.matched || c.matches(fields),
+	}
+}
+
+func (c jobCore) Check(ent zapcore.Entry, ce *zapcore.CheckedEntry) *zapcore.CheckedEntry {
+	if c.Enabled(ent.Level) {
+		return ce.AddCore(ent, c)
+	}
+	return ce
+}
+
+func (c jobCore) Write(ent zapcore.Entry, fields []zapcore.Field) error {
+	if ent.Level < c.base && !c.matched && !c.matches(fields) {
+		return nil
+	}
+	return c.Core.Write(ent, fields)
+}
+
+// redactCore masks secrets and sensitive data in messages and string fields
+// before they are written, see package redact
+type redactCore struct {
+	zapcore.Core
+}
+
+func (c redactCore) With(fields []zapcore.Field) zapcore.Core {
+	return redactCore{c.Core.With(redactFields(fields))}
+}
+
+func (c redactCore) Check(ent zapcore.Entry, ce *zapcore.CheckedEntry) *zapcore.CheckedEntry {
+	if c.Enabled(ent.Level) {
+		return ce.AddCore(ent, c)
+	}
+	return ce
+}
+
+func (c redactCore) Write(ent zapcore.Entry, fields []zapcore.Field) error {
+	ent.Message = redact.String(ent.Message)
+	return c.Core.Write(ent, redactFields(fields))
+}
+
+func redactFields(fields []zapcore.Field) []zapcore.Field {
+	out := make([]zapcore.Field, len(fields))
+	for i, f := range fields {
+		switch f.Type {
+		case zapcore.StringType:
+			f.String = redact.String(f.String)
+		case zapcore.ByteStringType:
+			if b, ok := f.Interface.([]byte); ok {
+				f.Interface = []byte(redact.String(string(b)))
+			}
+		case zapcore.ErrorType:
+			if err, ok := f.Interface.(error); ok {
+				f = zap.String(f.Key, redact.String(err.Error()))
+			}
+		}
+		out[i] = f
+	}
+	return out
+}
+
 // Debug logs a debug message with the given fields
 func Debug(message string, fields ...zap.Field) {
 	singleton.Debug(message, fields...)
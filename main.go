@@ -1,7 +1,11 @@
 package main
 
 import (
+	"context"
 	"os"
+	"os/signal"
+	"strconv"
+	"syscall"
 	"time"
 	"net/http"
 
@@ -13,6 +17,10 @@ import (
 	"github.com/CheerChen/esalert/models"
 	"github.com/CheerChen/esalert/logger"
 	"github.com/CheerChen/esalert/actions"
+	"github.com/CheerChen/esalert/alert"
+	"github.com/CheerChen/esalert/metrics"
+	"github.com/CheerChen/esalert/redact"
+	"github.com/CheerChen/esalert/tracing"
 )
 
 func main() {
@@ -25,30 +33,97 @@ func main() {
 	path := os.Getenv("CONF_PATH")
 	conf := multiconfig.NewWithPath(path)
 
+	if err := redact.Load(conf); err != nil {
+		logger.Fatal("initializing redaction failed", zap.String("err", err.Error()))
+	}
+	if err := logger.Load(conf); err != nil {
+		logger.Fatal("initializing logger failed", zap.String("err", err.Error()))
+	}
+
 	err := models.InitDB(conf)
 	if err != nil {
 		logger.Fatal("initializing db failed", zap.String("err", err.Error()))
 	}
 	actions.Load(conf)
+	if err := alert.Load(conf); err != nil {
+		logger.Fatal("initializing clusters failed", zap.String("err", err.Error()))
+	}
+	shutdownTracing, err := tracing.Init(conf)
+	if err != nil {
+		logger.Fatal("initializing tracing failed", zap.String("err", err.Error()))
+	}
+	if err := controllers.Load(conf); err != nil {
+		logger.Fatal("initializing controllers failed", zap.String("err", err.Error()))
+	}
 
 	// 恢复现场：从 MYSQL 获取有效配置
 	jobCtrl := new(controllers.JobController)
 	jobCtrl.Recover()
 
 	// 同步配置：通过 REST-API 启动停止
-	watcher := r.Group("/watcher")
+	watcher := r.Group("/watcher", controllers.Auth())
 	{
 
 		// POST watcher/:id
-		watcher.POST("/:id", jobCtrl.Trigger)
+		watcher.POST("/:id", controllers.RequireRole(controllers.RoleOwner, controllers.RoleAdmin), jobCtrl.Trigger)
 
 		// DELETE watcher/:id
-		watcher.DELETE("/:id", jobCtrl.Stop)
+		watcher.DELETE("/:id", controllers.RequireRole(controllers.RoleOwner, controllers.RoleAdmin), jobCtrl.Stop)
 
 		// GET watcher list
 		watcher.GET("/", jobCtrl.List)
 	}
 
+	// 管理配置：按租户与 user_id 隔离
+	job := r.Group("/job", controllers.Auth())
+	{
+		job.GET("/", jobCtrl.Jobs)
+		job.GET("/:id", jobCtrl.Get)
+		job.GET("/:id/runs", jobCtrl.Runs)
+		job.POST("/", controllers.RequireRole(controllers.RoleOwner, controllers.RoleAdmin), jobCtrl.Create)
+		job.PUT("/:id", controllers.RequireRole(controllers.RoleOwner, controllers.RoleAdmin), jobCtrl.Update)
+		job.POST("/:id/rollback/:audit_id", controllers.RequireRole(controllers.RoleOwner, controllers.RoleAdmin), jobCtrl.Rollback)
+	}
+
+	// 测试：校验 job 定义并返回将要发送的查询，不保存
+	test := r.Group("/test", controllers.Auth())
+	{
+		test.POST("/job", jobCtrl.Test)
+	}
+
+	// 运行事件：Server-Sent Events
+	eventCtrl := new(controllers.EventController)
+	r.GET("/events", controllers.Auth(), eventCtrl.Stream)
+
+	// 审计日志
+	auditCtrl := new(controllers.AuditController)
+	r.GET("/audit", controllers.Auth(), auditCtrl.List)
+
+	// 管理 API token：仅 admin
+	tokenCtrl := new(controllers.TokenController)
+	token := r.Group("/token", controllers.Auth(), controllers.RequireRole(controllers.RoleAdmin))
+	{
+		token.POST("/", tokenCtrl.Create)
+		token.DELETE("/:id", tokenCtrl.Delete)
+	}
+
+	// 集群限流：查看与运行时调整，仅 admin
+	clusterCtrl := new(controllers.ClusterController)
+	cluster := r.Group("/cluster", controllers.Auth(), controllers.RequireRole(controllers.RoleAdmin))
+	{
+		cluster.GET("/limits", clusterCtrl.Limits)
+		cluster.PUT("/limits/:name", clusterCtrl.SetLimits)
+	}
+
+	// 健康检查：liveness 与 readiness，readiness 的详细错误仅 admin 可见
+	healthCtrl := new(controllers.HealthController)
+	r.GET("/healthz", healthCtrl.Live)
+	r.GET("/readyz", healthCtrl.Ready)
+	r.GET("/readyz/details", controllers.Auth(), controllers.RequireRole(controllers.RoleAdmin), healthCtrl.Details)
+
+	// Prometheus 指标
+	r.GET("/metrics", gin.WrapH(metrics.Handler()))
+
 	r.GET("/", func(c *gin.Context) {
 		c.JSON(http.StatusOK, string("Service Available"))
 	})
@@ -57,8 +132,27 @@ func main() {
 		c.JSON(http.StatusNotFound, string("Not Found"))
 	})
 
-	r.Run(":9000")
-
+	srv := &http.Server{Addr: ":9000", Handler: r}
+	go func() {
+		if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			logger.Fatal("http server failed", zap.String("err", err.Error()))
+		}
+	}()
+
+	// 优雅退出：收到 SIGTERM/SIGINT 后停止接收请求，并导出缓冲中的 span
+	quit := make(chan os.Signal, 1)
+	signal.Notify(quit, syscall.SIGTERM, syscall.SIGINT)
+	sig := <-quit
+	logger.Info("shutting down", zap.String("signal", sig.String()))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != nil {
+		logger.Error("http server shutdown failed", zap.String("err", err.Error()))
+	}
+	if err := shutdownTracing(ctx); err != nil {
+		logger.Error("flushing traces failed", zap.String("err", err.Error()))
+	}
 }
 
 func logHandler() gin.HandlerFunc {
@@ -71,6 +165,9 @@ func logHandler() gin.HandlerFunc {
 		end := time.Now()
 		latency := end.Sub(start)
 
+		metrics.HTTPRequests.WithLabelValues(c.Request.Method, c.HandlerName(), strconv.Itoa(c.Writer.Status())).Inc()
+		metrics.HTTPDuration.WithLabelValues(c.Request.Method, c.HandlerName()).Observe(latency.Seconds())
+
 		logger.Info(path,
 			zap.Int("status", c.Writer.Status()),
 			zap.String("method", c.Request.Method),
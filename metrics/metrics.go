@@ -0,0 +1,144 @@
+// Prometheus 指标
+package metrics
+
+import (
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+var (
+	// Runs counts finished runs by job, tenant and outcome (alert.Status*)
+	Runs = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "esalert_runs_total",
+		Help: "Alert runs by job and outcome.",
+	}, []string{"job", "tenant", "outcome"})
+
+	// SearchDuration observes the round trip of every search by host
+	SearchDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "esalert_search_duration_seconds",
+		Help:    "Latency of elasticsearch searches.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"host"})
+
+	// SearchRetries counts retried requests by cluster
+	SearchRetries = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "esalert_search_retries_total",
+		Help: "Retried elasticsearch requests by cluster.",
+	}, []string{"cluster"})
+
+	// ClusterBreakerOpen is 1 while the circuit breaker of a cluster is open
+	ClusterBreakerOpen = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "esalert_cluster_breaker_open",
+		Help: "Whether the circuit breaker of a cluster is open.",
+	}, []string{"cluster"})
+
+	// MsearchBatchSize observes how many searches each _msearch request
+	// carries by cluster
+	MsearchBatchSize = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "esalert_msearch_batch_size",
+		Help:    "Searches grouped into one _msearch request.",
+		Buckets: []float64{1, 2, 5, 10, 20, 50, 100},
+	}, []string{"cluster"})
+
+	// SearchCache counts cached searches by cluster and result (hit or miss)
+	SearchCache = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "esalert_search_cache_total",
+		Help: "Searches answered from the cache (hit) or elasticsearch (miss).",
+	}, []string{"cluster", "result"})
+
+	// ClusterLimit is the rate limit ("rate", per second), the burst
+	// ("burst") and the max concurrent requests ("concurrent") of a cluster,
+	// 0 means unlimited
+	ClusterLimit = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "esalert_cluster_limit",
+		Help: "Configured request limits of a cluster.",
+	}, []string{"cluster", "limit"})
+
+	// ClusterInflight is the number of requests in flight by cluster
+	ClusterInflight = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "esalert_cluster_inflight_requests",
+		Help: "Elasticsearch requests in flight by cluster.",
+	}, []string{"cluster"})
+
+	// ClusterQueued is the number of requests waiting for the limits of a
+	// cluster
+	ClusterQueued = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "esalert_cluster_queued_requests",
+		Help: "Elasticsearch requests waiting for the limits of a cluster.",
+	}, []string{"cluster"})
+
+	// SearchRateLimited counts requests which failed after waiting
+	// QueueTimeout for the limits of their cluster
+	SearchRateLimited = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "esalert_search_rate_limited_total",
+		Help: "Elasticsearch requests rejected by the rate limits of a cluster.",
+	}, []string{"cluster"})
+
+	// LuaDuration observes the execution of process steps
+	LuaDuration = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "esalert_lua_duration_seconds",
+		Help:    "Duration of lua process steps.",
+		Buckets: prometheus.DefBuckets,
+	})
+
+	// Actions counts actions by type and result (ok or failed)
+	Actions = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "esalert_actions_total",
+		Help: "Actions performed by type and result.",
+	}, []string{"type", "result"})
+
+	// SchedulerLag observes how late runs start compared to their planned
+	// fire time
+	SchedulerLag = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "esalert_scheduler_lag_seconds",
+		Help:    "Delay between planned and actual start of runs.",
+		Buckets: []float64{.01, .05, .1, .5, 1, 2, 5, 10, 30, 60},
+	})
+
+	// Watchers is the number of running watchers
+	Watchers = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "esalert_watchers",
+		Help: "Number of running watchers.",
+	})
+
+	// HTTPRequests counts api requests by method, handler and status
+	HTTPRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "esalert_http_requests_total",
+		Help: "API requests by method, handler and status.",
+	}, []string{"method", "handler", "status"})
+
+	// HTTPDuration observes api request latency by method and handler
+	HTTPDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "esalert_http_request_duration_seconds",
+		Help:    "Latency of API requests.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"method", "handler"})
+)
+
+func init() {
+	prometheus.MustRegister(
+		Runs,
+		SearchDuration,
+		SearchRetries,
+		ClusterBreakerOpen,
+		MsearchBatchSize,
+		SearchCache,
+		ClusterLimit,
+		ClusterInflight,
+		ClusterQueued,
+		SearchRateLimited,
+		LuaDuration,
+		Actions,
+		SchedulerLag,
+		Watchers,
+		HTTPRequests,
+		HTTPDuration,
+	)
+}
+
+// Handler serves every registered metric in the Prometheus exposition format
+func Handler() http.Handler {
+	return promhttp.Handler()
+}
@@ -0,0 +1,71 @@
+package models
+
+import "strings"
+
+type Audit struct {
+	Id        int64
+	TenantId  string `db:"tenant_id" json:"tenant_id"`
+	UserId    string `db:"user_id" json:"user_id"`
+	JobId     int64  `db:"job_id" json:"job_id"`
+	Action    string `db:"action" json:"action"`
+	Ip        string `db:"ip" json:"ip"`
+	Before    string `db:"before" json:"before"`
+	After     string `db:"after" json:"after"`
+	CreatedAt string `db:"created_at" json:"created_at"`
+}
+
+// AuditFilter narrows GetAudits, zero values are ignored
+type AuditFilter struct {
+	TenantId string
+	UserId   string
+	JobId    string
+	Action   string
+	Ip       string
+	Since    string // "2006-01-02 15:04:05", inclusive
+	Until    string // "2006-01-02 15:04:05", exclusive
+	Limit    int
+	Offset   int
+}
+
+func AddAudit(audit Audit) (err error) {
+	_, err = db.Exec("INSERT INTO alert_audit (tenant_id,user_id,job_id,action,ip,`before`,`after`) VALUES (?,?,?,?,?,?,?)",
+		audit.TenantId, audit.UserId, audit.JobId, audit.Action, audit.Ip, audit.Before, audit.After)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+func GetAuditById(id string, tenantId string) (audit Audit, err error) {
+	err = db.Get(&audit, "SELECT id,tenant_id,user_id,job_id,action,ip,`before`,`after`,created_at FROM alert_audit WHERE id=? AND tenant_id=? LIMIT 1", id, tenantId)
+	if err != nil {
+		return audit, err
+	}
+	return audit, nil
+}
+
+func GetAudits(f AuditFilter) (audits []Audit, err error) {
+	conds := []string{"1=1"}
+	args := make([]interface{}, 0, 8)
+	add := func(cond string, v string) {
+		if v != "" {
+			conds = append(conds, cond)
+			args = append(args, v)
+		}
+	}
+	add("tenant_id=?", f.TenantId)
+	add("user_id=?", f.UserId)
+	add("job_id=?", f.JobId)
+	add("action=?", f.Action)
+	add("ip=?", f.Ip)
+	add("created_at>=?", f.Since)
+	add("created_at<?", f.Until)
+	args = append(args, f.Limit, f.Offset)
+
+	err = db.Select(&audits, "SELECT id,tenant_id,user_id,job_id,action,ip,`before`,`after`,created_at FROM alert_audit WHERE "+
+		strings.Join(conds, " AND ")+" ORDER BY id DESC LIMIT ? OFFSET ?", args...)
+	if err != nil {
+		return audits, err
+	}
+	return audits, nil
+}
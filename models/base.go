@@ -1,11 +1,14 @@
 package models
 
 import (
+	"context"
 	"fmt"
 
 	_ "github.com/go-sql-driver/mysql"
 	"github.com/jmoiron/sqlx"
 	"github.com/koding/multiconfig"
+
+	"github.com/CheerChen/esalert/redact"
 )
 
 var db *sqlx.DB
@@ -15,7 +18,8 @@ type ServerConf struct {
 	DBMaxIdle int    `default:"200"`
 	DBMaxOpen int    `default:"200"`
 
-	Mysql MysqlConf
+	Mysql      MysqlConf
+	Datasource map[string]DatasourceConf
 }
 
 type MysqlConf struct {
@@ -29,6 +33,7 @@ type MysqlConf struct {
 func InitDB(loader *multiconfig.DefaultLoader) (err error) {
 	conf := new(ServerConf)
 	loader.MustLoad(conf)
+	redact.Secret(conf.Mysql.Pwd)
 	var dsn string
 	switch conf.DBDriver {
 	case "mysql":
@@ -50,5 +55,10 @@ func InitDB(loader *multiconfig.DefaultLoader) (err error) {
 	}
 	db.SetMaxIdleConns(conf.DBMaxIdle)
 	db.SetMaxOpenConns(conf.DBMaxOpen)
-	return nil
+	return initDatasources(conf.Datasource)
+}
+
+// Ping checks the db connection is still alive
+func Ping(ctx context.Context) error {
+	return db.PingContext(ctx)
 }
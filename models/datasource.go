@@ -0,0 +1,173 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+	"github.com/jmoiron/sqlx"
+
+	"github.com/CheerChen/esalert/redact"
+)
+
+// DatasourceConf describes a database alerts can query with the sql input,
+// see [Datasource.<name>]
+type DatasourceConf struct {
+	Driver  string   // default mysql
+	DSN     string   // e.g. "user:pass@tcp(127.0.0.1:3306)/db?charset=utf8"
+	MaxOpen int      // connections, default 5
+	Timeout string   // of a single query, default "10s"
+	MaxRows int      // rows returned at most, default 1000
+	Tenants []string // tenants allowed to query it, "*" for every tenant, empty for none
+}
+
+type datasource struct {
+	conf    DatasourceConf
+	db      *sqlx.DB
+	timeout time.Duration
+}
+
+var datasources = make(map[string]*datasource)
+
+// initDatasources opens the datasources lazily, an unreachable one only
+// fails the alerts querying it
+func initDatasources(confs map[string]DatasourceConf) error {
+	m := make(map[string]*datasource, len(confs))
+	for name, dc := range confs {
+		if dc.Driver == "" {
+			dc.Driver = "mysql"
+		}
+		if dc.MaxOpen == 0 {
+			dc.MaxOpen = 5
+		}
+		if dc.Timeout == "" {
+			dc.Timeout = "10s"
+		}
+		if dc.MaxRows == 0 {
+			dc.MaxRows = 1000
+		}
+		timeout, err := time.ParseDuration(dc.Timeout)
+		if err != nil {
+			return fmt.Errorf("datasource %s: Timeout: %s", name, err)
+		}
+
+		redact.Secret(dc.DSN)
+		if dc.Driver == "mysql" {
+			if c, err := mysql.ParseDSN(dc.DSN); err == nil {
+				redact.Secret(c.Passwd)
+			}
+		}
+		db, err := sqlx.Open(dc.Driver, dc.DSN)
+		if err != nil {
+			return fmt.Errorf("datasource %s: %s", name, err)
+		}
+		db.SetMaxOpenConns(dc.MaxOpen)
+		db.SetMaxIdleConns(dc.MaxOpen)
+		m[name] = &datasource{conf: dc, db: db, timeout: timeout}
+	}
+	datasources = m
+	return nil
+}
+
+// GetDatasource returns the settings of a datasource the tenant may query
+func GetDatasource(name, tenantId string) (dc DatasourceConf, err error) {
+	ds, ok := datasources[name]
+	if !ok || !ds.allows(tenantId) {
+		return dc, fmt.Errorf("unknown datasource: %q", name)
+	}
+	return ds.conf, nil
+}
+
+// allows tells whether tenantId may query ds, a datasource without Tenants
+// is closed to everyone
+func (ds *datasource) allows(tenantId string) bool {
+	for _, t := range ds.conf.Tenants {
+		if t == "*" || t == tenantId {
+			return true
+		}
+	}
+	return false
+}
+
+// readOnlyStatements are the statements QueryDatasource accepts
+var readOnlyStatements = []string{"select", "with", "show", "explain", "describe", "desc"}
+
+// CheckReadOnly rejects anything but a single read-only statement
+func CheckReadOnly(query string) error {
+	q := strings.TrimRight(strings.TrimSpace(query), "; \t\n")
+	if strings.Contains(q, ";") {
+		return errors.New("only a single statement is allowed")
+	}
+	fields := strings.Fields(q)
+	if len(fields) == 0 {
+		return errors.New("empty query")
+	}
+	first := strings.ToLower(fields[0])
+	for _, s := range readOnlyStatements {
+		if first == s {
+			return nil
+		}
+	}
+	return fmt.Errorf("%s statements are not allowed, the query must be read-only", strings.ToUpper(first))
+}
+
+// QueryDatasource runs a read-only query in a read-only transaction, which is
+// always rolled back. At most maxRows rows are returned (the datasource
+// MaxRows when 0 or above it), truncated tells there were more. []byte
+// columns are returned as strings and times as RFC3339
+func QueryDatasource(ctx context.Context, name, tenantId, query string, maxRows int, timeout time.Duration) (rows []map[string]interface{}, truncated bool, err error) {
+	ds, ok := datasources[name]
+	if !ok || !ds.allows(tenantId) {
+		return rows, false, fmt.Errorf("unknown datasource: %q", name)
+	}
+	if err := CheckReadOnly(query); err != nil {
+		return rows, false, err
+	}
+	if maxRows <= 0 || maxRows > ds.conf.MaxRows {
+		maxRows = ds.conf.MaxRows
+	}
+	if timeout <= 0 || timeout > ds.timeout {
+		timeout = ds.timeout
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	tx, err := ds.db.BeginTxx(ctx, &sql.TxOptions{ReadOnly: true})
+	if err != nil {
+		return rows, false, err
+	}
+	defer tx.Rollback()
+
+	rs, err := tx.QueryxContext(ctx, query)
+	if err != nil {
+		return rows, false, err
+	}
+	defer rs.Close()
+	for rs.Next() {
+		if len(rows) >= maxRows {
+			truncated = true
+			break
+		}
+		row := make(map[string]interface{})
+		if err := rs.MapScan(row); err != nil {
+			return rows, truncated, err
+		}
+		for k, v := range row {
+			switch vv := v.(type) {
+			case []byte:
+				row[k] = string(vv)
+			case time.Time:
+				row[k] = vv.Format(time.RFC3339)
+			}
+		}
+		rows = append(rows, row)
+	}
+	if err := rs.Err(); err != nil {
+		return rows, truncated, err
+	}
+	return rows, truncated, nil
+}
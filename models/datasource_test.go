@@ -0,0 +1,128 @@
+package models
+
+import (
+	"context"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// openTestDatasources opens an sqlite datasource "orders" with a few rows,
+// open to the given tenants
+func openTestDatasources(t *testing.T, maxRows int, tenants ...string) {
+	dsn := filepath.Join(t.TempDir(), "orders.db")
+	err := initDatasources(map[string]DatasourceConf{
+		"orders": {Driver: "sqlite3", DSN: dsn, MaxRows: maxRows, Tenants: tenants},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	db := datasources["orders"].db
+	t.Cleanup(func() {
+		db.Close()
+		datasources = make(map[string]*datasource)
+	})
+	for _, q := range []string{
+		`CREATE TABLE orders (id INTEGER, status TEXT, note BLOB)`,
+		`INSERT INTO orders VALUES (1, 'paid', 'a'), (2, 'failed', 'b'), (3, 'failed', 'c')`,
+	} {
+		if _, err := db.Exec(q); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestDatasourceTenants(t *testing.T) {
+	tests := []struct {
+		name    string
+		tenants []string
+		tenant  string
+		allowed bool
+	}{
+		{name: "no tenants", tenants: nil, tenant: "payments", allowed: false},
+		{name: "listed tenant", tenants: []string{"payments"}, tenant: "payments", allowed: true},
+		{name: "other tenant", tenants: []string{"payments"}, tenant: "shipping", allowed: false},
+		{name: "every tenant", tenants: []string{"*"}, tenant: "shipping", allowed: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			openTestDatasources(t, 0, tt.tenants...)
+			_, err := GetDatasource("orders", tt.tenant)
+			if (err == nil) != tt.allowed {
+				t.Errorf("GetDatasource error = %v, want allowed %v", err, tt.allowed)
+			}
+			_, _, err = QueryDatasource(context.Background(), "orders", tt.tenant, "SELECT id FROM orders", 0, 0)
+			if (err == nil) != tt.allowed {
+				t.Errorf("QueryDatasource error = %v, want allowed %v", err, tt.allowed)
+			}
+		})
+	}
+}
+
+func TestQueryDatasource(t *testing.T) {
+	tests := []struct {
+		name      string
+		query     string
+		maxRows   int
+		rows      []map[string]interface{}
+		truncated bool
+		err       bool
+	}{
+		{
+			name:  "rows with blobs as strings",
+			query: "SELECT id, note FROM orders WHERE status = 'failed' ORDER BY id",
+			rows: []map[string]interface{}{
+				{"id": int64(2), "note": "b"},
+				{"id": int64(3), "note": "c"},
+			},
+		},
+		{
+			name:      "job max_rows",
+			query:     "SELECT id FROM orders ORDER BY id",
+			maxRows:   1,
+			rows:      []map[string]interface{}{{"id": int64(1)}},
+			truncated: true,
+		},
+		{
+			name:      "capped by the datasource MaxRows",
+			query:     "SELECT id FROM orders ORDER BY id",
+			maxRows:   10,
+			rows:      []map[string]interface{}{{"id": int64(1)}, {"id": int64(2)}},
+			truncated: true,
+		},
+		{
+			name:  "write statement",
+			query: "DELETE FROM orders",
+			err:   true,
+		},
+		{
+			name:  "several statements",
+			query: "SELECT 1; DELETE FROM orders",
+			err:   true,
+		},
+	}
+
+	openTestDatasources(t, 2, "payments")
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rows, truncated, err := QueryDatasource(context.Background(), "orders", "payments", tt.query, tt.maxRows, 0)
+			if (err != nil) != tt.err {
+				t.Fatalf("error = %v, want error %v", err, tt.err)
+			}
+			if tt.err {
+				return
+			}
+			if !reflect.DeepEqual(rows, tt.rows) || truncated != tt.truncated {
+				t.Errorf("got %v truncated %v, want %v truncated %v", rows, truncated, tt.rows, tt.truncated)
+			}
+		})
+	}
+
+	var count int
+	if err := datasources["orders"].db.Get(&count, "SELECT COUNT(*) FROM orders"); err != nil || count != 3 {
+		t.Errorf("orders has %d rows (%v) after the queries, want 3", count, err)
+	}
+}
@@ -1,7 +1,10 @@
 package models
 
+import "strings"
+
 type Job struct {
 	Id        int64
+	TenantId  string `db:"tenant_id"`
 	UserId    string `db:"user_id"`
 	Name      string `db:"name"`
 	Value     string `db:"value"`
@@ -11,8 +14,44 @@ type Job struct {
 	//CreatedAt time.Time `db:"created_at"`
 }
 
-func GetJobById(id string) (job Job, err error) {
-	err = db.Get(&job, "SELECT id,value,status,is_deleted FROM alert_job WHERE id=? LIMIT 1", id)
+// Scope restricts job queries to the jobs a caller may see. An empty UserId
+// means no restriction on the owner within the tenant
+type Scope struct {
+	TenantId string
+	UserId   string
+}
+
+// Covers tells whether job is visible within the scope
+func (s Scope) Covers(job Job) bool {
+	if s.TenantId != "" && s.TenantId != job.TenantId {
+		return false
+	}
+	return s.UserId == "" || s.UserId == job.UserId
+}
+
+func (s Scope) where() (string, []interface{}) {
+	conds := make([]string, 0, 2)
+	args := make([]interface{}, 0, 2)
+	if s.TenantId != "" {
+		conds = append(conds, "tenant_id=?")
+		args = append(args, s.TenantId)
+	}
+	if s.UserId != "" {
+		conds = append(conds, "user_id=?")
+		args = append(args, s.UserId)
+	}
+	if len(conds) == 0 {
+		return "", args
+	}
+	return " AND " + strings.Join(conds, " AND "), args
+}
+
+const jobColumns = "id,tenant_id,user_id,name,value,status,is_deleted"
+
+func GetJobById(id string, scope Scope) (job Job, err error) {
+	where, args := scope.where()
+	err = db.Get(&job, "SELECT "+jobColumns+" FROM alert_job WHERE id=?"+where+" LIMIT 1",
+		append([]interface{}{id}, args...)...)
 	if err != nil {
 		return job, err
 	}
@@ -20,13 +59,49 @@ func GetJobById(id string) (job Job, err error) {
 }
 
 func GetJobs() (jobs []Job, err error) {
-	err = db.Select(&jobs, "SELECT id,value,status,is_deleted FROM alert_job WHERE status=1 AND is_deleted=0")
+	err = db.Select(&jobs, "SELECT "+jobColumns+" FROM alert_job WHERE status=1 AND is_deleted=0")
+	if err != nil {
+		return jobs, err
+	}
+	return jobs, nil
+}
+
+func GetJobsByScope(scope Scope) (jobs []Job, err error) {
+	where, args := scope.where()
+	err = db.Select(&jobs, "SELECT "+jobColumns+" FROM alert_job WHERE is_deleted=0"+where, args...)
 	if err != nil {
 		return jobs, err
 	}
 	return jobs, nil
 }
 
+func CountJobs(scope Scope) (count int, err error) {
+	where, args := scope.where()
+	err = db.Get(&count, "SELECT COUNT(*) FROM alert_job WHERE is_deleted=0"+where, args...)
+	if err != nil {
+		return 0, err
+	}
+	return count, nil
+}
+
+func AddJob(job Job) (id int64, err error) {
+	res, err := db.Exec("INSERT INTO alert_job (tenant_id,user_id,name,value,status) VALUES (?,?,?,?,?)",
+		job.TenantId, job.UserId, job.Name, job.Value, job.Status)
+	if err != nil {
+		return 0, err
+	}
+	return res.LastInsertId()
+}
+
+func UpdateJobById(id string, job Job) (err error) {
+	_, err = db.Exec("UPDATE alert_job SET name=?,value=?,status=?,updated_at=CURRENT_TIMESTAMP WHERE id=? LIMIT 1",
+		job.Name, job.Value, job.Status, id)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
 func DelJobById(id string) (err error) {
 	_, err = db.Exec("UPDATE alert_job SET is_deleted = 1 WHERE id=? LIMIT 1", id)
 	if err != nil {
@@ -0,0 +1,37 @@
+package models
+
+type Run struct {
+	Id           int64
+	TenantId     string `db:"tenant_id" json:"tenant_id"`
+	JobId        int64  `db:"job_id" json:"job_id"`
+	Status       string `db:"status" json:"status"`
+	Step         string `db:"step" json:"step"`
+	Hits         uint64 `db:"hits" json:"hits"`
+	Actions      int    `db:"actions" json:"actions"`
+	Error        string `db:"error" json:"error"`
+	ErrorType    string `db:"error_type" json:"error_type"`
+	ShardsTotal  int    `db:"shards_total" json:"shards_total"`
+	ShardsFailed int    `db:"shards_failed" json:"shards_failed"`
+	Cache        string `db:"cache" json:"cache"`
+	StartedAt    string `db:"started_at" json:"started_at"`
+	DurationMS   int64  `db:"duration_ms" json:"duration_ms"`
+	TraceId      string `db:"trace_id" json:"trace_id"`
+}
+
+func AddRun(run Run) (err error) {
+	_, err = db.Exec("INSERT INTO alert_run (tenant_id,job_id,status,step,hits,actions,error,error_type,shards_total,shards_failed,cache,started_at,duration_ms,trace_id) VALUES (?,?,?,?,?,?,?,?,?,?,?,?,?,?)",
+		run.TenantId, run.JobId, run.Status, run.Step, run.Hits, run.Actions, run.Error, run.ErrorType, run.ShardsTotal, run.ShardsFailed, run.Cache, run.StartedAt, run.DurationMS, run.TraceId)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+func GetRunsByJobId(jobId int64, tenantId string, limit int) (runs []Run, err error) {
+	err = db.Select(&runs, "SELECT id,tenant_id,job_id,status,step,hits,actions,error,error_type,shards_total,shards_failed,cache,started_at,duration_ms,trace_id FROM alert_run WHERE job_id=? AND tenant_id=? ORDER BY id DESC LIMIT ?",
+		jobId, tenantId, limit)
+	if err != nil {
+		return runs, err
+	}
+	return runs, nil
+}
@@ -0,0 +1,36 @@
+package models
+
+type Token struct {
+	Id        int64
+	TenantId  string `db:"tenant_id"`
+	UserId    string `db:"user_id"`
+	Name      string `db:"name"`
+	Role      string `db:"role"`
+	TokenHash string `db:"token_hash"`
+	IsDeleted int    `db:"is_deleted"`
+}
+
+func GetTokenByHash(hash string) (token Token, err error) {
+	err = db.Get(&token, "SELECT id,tenant_id,user_id,name,role,token_hash,is_deleted FROM alert_token WHERE token_hash=? AND is_deleted=0 LIMIT 1", hash)
+	if err != nil {
+		return token, err
+	}
+	return token, nil
+}
+
+func AddToken(token Token) (id int64, err error) {
+	res, err := db.Exec("INSERT INTO alert_token (tenant_id,user_id,name,role,token_hash) VALUES (?,?,?,?,?)",
+		token.TenantId, token.UserId, token.Name, token.Role, token.TokenHash)
+	if err != nil {
+		return 0, err
+	}
+	return res.LastInsertId()
+}
+
+func DelTokenById(id string, tenantId string) (err error) {
+	_, err = db.Exec("UPDATE alert_token SET is_deleted = 1 WHERE id=? AND tenant_id=? LIMIT 1", id, tenantId)
+	if err != nil {
+		return err
+	}
+	return nil
+}
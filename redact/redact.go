@@ -0,0 +1,183 @@
+// 脱敏：日志、运行记录与 API 响应中的敏感信息
+package redact
+
+import (
+	"bytes"
+	"encoding/json"
+	"regexp"
+	"strings"
+	"sync"
+
+	"github.com/koding/multiconfig"
+)
+
+// Mask replaces every redacted value
+const Mask = "[REDACTED]"
+
+type ServerConf struct {
+	Redact RedactConf
+}
+
+type RedactConf struct {
+	// Fields are json paths whose values are masked, e.g.
+	// "hits.hits._source.user.email". Arrays are traversed transparently, "*"
+	// matches any key, and a path without dots matches the key at any depth
+	Fields []string
+	// Patterns are regular expressions masked in any string
+	Patterns []string
+	// Builtin masks emails, bearer tokens and phone numbers
+	Builtin bool `default:"true"`
+}
+
+var builtinPatterns = []string{
+	`[A-Za-z0-9._%+\-]+@[A-Za-z0-9.\-]+\.[A-Za-z]{2,}`,
+	`(?i)bearer\s+[A-Za-z0-9\-._~+/]+=*`,
+	`(?i)(token|api_key|apikey|password|passwd|pwd)=[^&\s"]+`,
+	`\b1[3-9]\d{9}\b`,
+	`\+\d{1,3}[\s\-]?\d{6,14}\b`,
+}
+
+var (
+	mu       sync.RWMutex
+	fields   [][]string
+	keys     map[string]bool
+	patterns []*regexp.Regexp
+	secrets  []string
+)
+
+func init() {
+	keys = make(map[string]bool)
+	setPatterns(builtinPatterns)
+}
+
+// Load replaces the field paths and patterns with the [Redact] section
+func Load(loader *multiconfig.DefaultLoader) error {
+	conf := new(ServerConf)
+	loader.MustLoad(conf)
+
+	var ps []string
+	if conf.Redact.Builtin {
+		ps = append(ps, builtinPatterns...)
+	}
+	ps = append(ps, conf.Redact.Patterns...)
+	for _, p := range ps {
+		if _, err := regexp.Compile(p); err != nil {
+			return err
+		}
+	}
+	setPatterns(ps)
+
+	mu.Lock()
+	defer mu.Unlock()
+	fields = nil
+	keys = make(map[string]bool)
+	for _, f := range conf.Redact.Fields {
+		if !strings.Contains(f, ".") {
+			keys[f] = true
+			continue
+		}
+		fields = append(fields, strings.Split(f, "."))
+	}
+	return nil
+}
+
+func setPatterns(ps []string) {
+	compiled := make([]*regexp.Regexp, 0, len(ps))
+	for _, p := range ps {
+		compiled = append(compiled, regexp.MustCompile(p))
+	}
+	mu.Lock()
+	patterns = compiled
+	mu.Unlock()
+}
+
+// Secret registers values, such as passwords from the config, which are
+// masked wherever they show up
+func Secret(values ...string) {
+	mu.Lock()
+	defer mu.Unlock()
+	for _, v := range values {
+		if len(v) >= 4 {
+			secrets = append(secrets, v)
+		}
+	}
+}
+
+// String masks secrets and pattern matches in s
+func String(s string) string {
+	mu.RLock()
+	defer mu.RUnlock()
+	for _, v := range secrets {
+		s = strings.Replace(s, v, Mask, -1)
+	}
+	for _, re := range patterns {
+		s = re.ReplaceAllString(s, Mask)
+	}
+	return s
+}
+
+// JSON masks the configured field paths of a json document, then applies
+// String to the result. Numbers are kept as written, so large ids don't go
+// through float64. Documents which do not parse are only passed through
+// String
+func JSON(b []byte) []byte {
+	var v interface{}
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.UseNumber()
+	if err := dec.Decode(&v); err != nil || dec.More() {
+		return []byte(String(string(b)))
+	}
+	out, err := json.Marshal(Value(v))
+	if err != nil {
+		return []byte(String(string(b)))
+	}
+	return out
+}
+
+// Value returns a copy of a decoded json value (maps, slices and scalars)
+// with the configured field paths masked and String applied to every string
+func Value(v interface{}) interface{} {
+	mu.RLock()
+	fs, ks := fields, keys
+	mu.RUnlock()
+	return walk(v, fs, ks)
+}
+
+// walk masks v, paths holds the remaining segments of every field path
+// which matched so far
+func walk(v interface{}, paths [][]string, ks map[string]bool) interface{} {
+	for _, p := range paths {
+		if len(p) == 0 {
+			return Mask
+		}
+	}
+
+	switch vv := v.(type) {
+	case map[string]interface{}:
+		m := make(map[string]interface{}, len(vv))
+		for k, e := range vv {
+			if ks[k] {
+				m[k] = Mask
+				continue
+			}
+			var next [][]string
+			for _, p := range paths {
+				if p[0] == "*" || p[0] == k {
+					next = append(next, p[1:])
+				}
+			}
+			m[k] = walk(e, next, ks)
+		}
+		return m
+	case []interface{}:
+		s := make([]interface{}, len(vv))
+		for i, e := range vv {
+			s[i] = walk(e, paths, ks)
+		}
+		return s
+	case string:
+		return String(vv)
+	default:
+		return v
+	}
+}
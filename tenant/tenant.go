@@ -0,0 +1,23 @@
+// 租户：配置、渠道与数据按租户隔离
+package tenant
+
+import "context"
+
+// Default owns every job and token created before tenants existed, it uses
+// the global settings
+const Default = "default"
+
+type ctxKey struct{}
+
+// NewContext returns a copy of ctx carrying the given tenant
+func NewContext(ctx context.Context, name string) context.Context {
+	return context.WithValue(ctx, ctxKey{}, name)
+}
+
+// FromContext returns the tenant carried by ctx, or Default
+func FromContext(ctx context.Context) string {
+	if name, ok := ctx.Value(ctxKey{}).(string); ok && name != "" {
+		return name
+	}
+	return Default
+}
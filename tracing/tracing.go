@@ -0,0 +1,110 @@
+// OpenTelemetry 链路追踪
+package tracing
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/koding/multiconfig"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+type ServerConf struct {
+	Tracing TracingConf
+}
+
+type TracingConf struct {
+	Endpoint    string  `default:""` // host:port of an OTLP/HTTP collector, empty disables export
+	URLPath     string  `default:"/v1/traces"`
+	Insecure    bool    `default:"true"`
+	ServiceName string  `default:"esalert"`
+	SampleRatio float64 `default:"1"`
+}
+
+const instrumentation = "github.com/CheerChen/esalert"
+
+// Init installs the global tracer provider and propagator. The returned
+// function flushes pending spans and should be called on shutdown
+func Init(loader *multiconfig.DefaultLoader) (func(context.Context) error, error) {
+	conf := new(ServerConf)
+	loader.MustLoad(conf)
+
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(
+		propagation.TraceContext{},
+		propagation.Baggage{},
+	))
+	if conf.Tracing.Endpoint == "" {
+		return func(context.Context) error { return nil }, nil
+	}
+
+	opts := []otlptracehttp.Option{
+		otlptracehttp.WithEndpoint(conf.Tracing.Endpoint),
+		otlptracehttp.WithURLPath(conf.Tracing.URLPath),
+	}
+	if conf.Tracing.Insecure {
+		opts = append(opts, otlptracehttp.WithInsecure())
+	}
+	exporter, err := otlptracehttp.New(context.Background(), opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	tp := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(conf.Tracing.SampleRatio))),
+		sdktrace.WithResource(resource.NewSchemaless(
+			attribute.String("service.name", conf.Tracing.ServiceName),
+		)),
+	)
+	otel.SetTracerProvider(tp)
+	return tp.Shutdown, nil
+}
+
+// Start opens a span as a child of whatever span ctx carries
+func Start(ctx context.Context, name string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	return otel.Tracer(instrumentation).Start(ctx, name, trace.WithAttributes(attrs...))
+}
+
+// StartLinked opens the root span of a new trace linked to the spans others
+// carry, for work done on behalf of several traces at once
+func StartLinked(ctx context.Context, name string, others []context.Context, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	links := make([]trace.Link, 0, len(others))
+	for _, o := range others {
+		if sc := trace.SpanContextFromContext(o); sc.IsValid() {
+			links = append(links, trace.Link{SpanContext: sc})
+		}
+	}
+	return otel.Tracer(instrumentation).Start(ctx, name,
+		trace.WithNewRoot(), trace.WithLinks(links...), trace.WithAttributes(attrs...))
+}
+
+// End records err on the span, if any, and ends it
+func End(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// Inject writes the trace context of ctx into the headers of an outbound
+// request
+func Inject(ctx context.Context, header http.Header) {
+	otel.GetTextMapPropagator().Inject(ctx, propagation.HeaderCarrier(header))
+}
+
+// TraceID returns the id of the trace ctx belongs to, or an empty string
+func TraceID(ctx context.Context) string {
+	sc := trace.SpanContextFromContext(ctx)
+	if !sc.HasTraceID() {
+		return ""
+	}
+	return sc.TraceID().String()
+}